@@ -0,0 +1,536 @@
+package MesonTerminalEchoServer
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An EvictionPolicy decides which files a CacheIndex evicts first.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently served files first.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least often served files first, the least
+	// recently served of them on a tie.
+	EvictLFU
+)
+
+// A CacheIndex tracks the size and use of the cached files served by
+// FileWithPause and keeps them within a byte quota for the node and for each
+// bindname. A file counts with its sidecars and precompressed variants, and
+// is removed together with them when evicted. The index is persisted to a
+// file so it survives restarts.
+type CacheIndex struct {
+	path   string
+	policy EvictionPolicy
+
+	mu         sync.Mutex
+	nodeQuota  int64
+	bindQuotas map[string]int64
+	items      map[string]*cacheItem
+	total      int64
+	bindTotals map[string]int64
+	// queue orders all files for eviction, bindQueues the files of each
+	// bindname.
+	queue      evictionQueue
+	bindQueues map[string]evictionQueue
+	dirty      bool
+	// invalidate, if set, drops a removed file from the server's caches.
+	invalidate func(path string)
+}
+
+// A CacheEntry is what a CacheIndex knows about a cached file.
+type CacheEntry struct {
+	Path     string `json:"path"`
+	BindName string `json:"bindname,omitempty"`
+	Size     int64  `json:"size"`
+	// Extra is the size of the file's sidecars and precompressed variants.
+	Extra      int64     `json:"extra,omitempty"`
+	LastAccess time.Time `json:"last_access"`
+	Hits       uint64    `json:"hits"`
+}
+
+// measureInterval is how often the sidecars and variants of a file that is
+// being served are measured again.
+const measureInterval = time.Minute
+
+// A cacheItem is a CacheEntry with its place in the eviction queues.
+type cacheItem struct {
+	CacheEntry
+	measured time.Time
+	// pos is the position in the node queue and in the bindname's queue.
+	pos [2]queuePos
+}
+
+func (it *cacheItem) diskSize() int64 { return it.Size + it.Extra }
+
+// NewCacheIndex loads the index persisted at indexPath, if any, dropping the
+// files that no longer exist. nodeQuota is the most bytes kept in total;
+// 0 means no limit.
+func NewCacheIndex(indexPath string, policy EvictionPolicy, nodeQuota int64) (*CacheIndex, error) {
+	ci := &CacheIndex{
+		path:       indexPath,
+		policy:     policy,
+		nodeQuota:  nodeQuota,
+		bindQuotas: map[string]int64{},
+		items:      map[string]*cacheItem{},
+		bindTotals: map[string]int64{},
+		bindQueues: map[string]evictionQueue{},
+	}
+	ci.queue = ci.newQueue(0)
+	data, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return ci, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []CacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("cache index %s: %v", indexPath, err)
+	}
+	// the queues take the files in the order they were last served
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastAccess.Before(entries[j].LastAccess) })
+	now := time.Now()
+	for _, e := range entries {
+		fi, err := os.Stat(e.Path)
+		if err != nil || !fi.Mode().IsRegular() {
+			ci.dirty = true
+			continue
+		}
+		e.Size = fi.Size()
+		e.Extra = companionSize(e.Path)
+		ci.add(&cacheItem{CacheEntry: e, measured: now})
+	}
+	return ci, nil
+}
+
+func (ci *CacheIndex) newQueue(slot int) evictionQueue {
+	if ci.policy == EvictLFU {
+		return &lfuQueue{slot: slot}
+	}
+	return &lruQueue{slot: slot, l: list.New()}
+}
+
+func (ci *CacheIndex) add(it *cacheItem) {
+	ci.items[it.Path] = it
+	ci.total += it.diskSize()
+	ci.bindTotals[it.BindName] += it.diskSize()
+	ci.queue.add(it)
+	q, ok := ci.bindQueues[it.BindName]
+	if !ok {
+		q = ci.newQueue(1)
+		ci.bindQueues[it.BindName] = q
+	}
+	q.add(it)
+}
+
+func (ci *CacheIndex) remove(it *cacheItem) {
+	delete(ci.items, it.Path)
+	ci.total -= it.diskSize()
+	ci.bindTotals[it.BindName] -= it.diskSize()
+	ci.queue.remove(it)
+	q := ci.bindQueues[it.BindName]
+	q.remove(it)
+	if q.len() == 0 {
+		delete(ci.bindTotals, it.BindName)
+		delete(ci.bindQueues, it.BindName)
+	}
+}
+
+// companionSize returns the size of the sidecars and precompressed variants
+// of the file at path.
+func companionSize(path string) int64 {
+	var size int64
+	for _, suffix := range companionSuffixes() {
+		if fi, err := os.Stat(path + suffix); err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// companionSuffixes returns the suffixes of the files stored next to a
+// cached file: its sidecars and precompressed variants.
+func companionSuffixes() []string {
+	encodingMu.RLock()
+	defer encodingMu.RUnlock()
+	suffixes := []string{HeaderSuffix, DigestSuffix, PartsSuffix}
+	for _, ext := range encodingExt {
+		suffixes = append(suffixes, ext)
+	}
+	return suffixes
+}
+
+// SetNodeQuota sets the most bytes kept in total, 0 for no limit, and
+// evicts files until the cache fits.
+func (ci *CacheIndex) SetNodeQuota(quota int64) {
+	ci.mu.Lock()
+	ci.nodeQuota = quota
+	victims := ci.collectVictims("", nil)
+	ci.mu.Unlock()
+	ci.evictFiles(victims)
+}
+
+// SetBindNameQuota sets the most bytes kept for bindName, 0 for no limit
+// beyond the node quota, and evicts its files until they fit.
+func (ci *CacheIndex) SetBindNameQuota(bindName string, quota int64) {
+	ci.mu.Lock()
+	if quota > 0 {
+		ci.bindQuotas[bindName] = quota
+	} else {
+		delete(ci.bindQuotas, bindName)
+	}
+	victims := ci.collectVictims(bindName, nil)
+	ci.mu.Unlock()
+	ci.evictFiles(victims)
+}
+
+// Touch records that the file at path of bindName, of size bytes, was
+// served, and evicts other files if the quotas are exceeded. The sidecars
+// and variants of the file are measured when it is new or changed, and
+// every minute while it is being served.
+func (ci *CacheIndex) Touch(path, bindName string, size int64) {
+	now := time.Now()
+	ci.mu.Lock()
+	it, ok := ci.items[path]
+	stale := !ok || it.Size != size || now.Sub(it.measured) >= measureInterval
+	ci.mu.Unlock()
+	extra := int64(-1)
+	if stale {
+		extra = companionSize(path)
+	}
+
+	ci.mu.Lock()
+	it, ok = ci.items[path]
+	if ok && (it.Size != size || it.BindName != bindName) {
+		ci.remove(it)
+		ok = false
+	}
+	if !ok {
+		var hits uint64
+		if it != nil {
+			hits = it.Hits
+		}
+		if extra < 0 {
+			extra = 0
+		}
+		it = &cacheItem{CacheEntry: CacheEntry{Path: path, BindName: bindName, Size: size, Extra: extra, Hits: hits}, measured: now}
+		ci.add(it)
+	} else if extra >= 0 {
+		ci.setExtra(it, extra, now)
+	}
+	it.LastAccess = now
+	it.Hits++
+	ci.queue.update(it)
+	ci.bindQueues[bindName].update(it)
+	ci.dirty = true
+	victims := ci.collectVictims(bindName, it)
+	ci.mu.Unlock()
+	ci.evictFiles(victims)
+}
+
+// setExtra sets the size of the sidecars and variants of it. ci.mu must be
+// held.
+func (ci *CacheIndex) setExtra(it *cacheItem, extra int64, now time.Time) {
+	ci.total += extra - it.Extra
+	ci.bindTotals[it.BindName] += extra - it.Extra
+	it.Extra = extra
+	it.measured = now
+}
+
+// remeasure measures the sidecars and variants of the file at path again,
+// after one of them was written, and evicts files if the quotas are now
+// exceeded.
+func (ci *CacheIndex) remeasure(path string) {
+	extra := companionSize(path)
+	ci.mu.Lock()
+	it, ok := ci.items[path]
+	if !ok {
+		ci.mu.Unlock()
+		return
+	}
+	ci.setExtra(it, extra, time.Now())
+	ci.dirty = true
+	victims := ci.collectVictims(it.BindName, it)
+	ci.mu.Unlock()
+	ci.evictFiles(victims)
+}
+
+// Forget drops the file at path from the index without removing it.
+func (ci *CacheIndex) Forget(path string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if it, ok := ci.items[path]; ok {
+		ci.remove(it)
+		ci.dirty = true
+	}
+}
+
+// Evict removes the file at path with its sidecars and drops it from the
+// index.
+func (ci *CacheIndex) Evict(path string) {
+	ci.mu.Lock()
+	it, ok := ci.items[path]
+	if ok {
+		ci.remove(it)
+		ci.dirty = true
+	}
+	ci.mu.Unlock()
+	ci.evictFiles([]string{path})
+}
+
+// collectVictims drops entries from the index until bindName and the node
+// fit their quotas and returns their paths. keep is never chosen. ci.mu
+// must be held.
+func (ci *CacheIndex) collectVictims(bindName string, keep *cacheItem) []string {
+	var victims []string
+	for {
+		bindQuota := ci.bindQuotas[bindName]
+		bindOver := bindQuota > 0 && ci.bindTotals[bindName] > bindQuota
+		nodeOver := ci.nodeQuota > 0 && ci.total > ci.nodeQuota
+		var q evictionQueue
+		switch {
+		case nodeOver:
+			q = ci.queue
+		case bindOver:
+			// only bindName is over its quota
+			q = ci.bindQueues[bindName]
+		}
+		if q == nil {
+			break
+		}
+		it := q.victim(keep)
+		if it == nil {
+			break
+		}
+		ci.remove(it)
+		victims = append(victims, it.Path)
+	}
+	if len(victims) > 0 {
+		ci.dirty = true
+	}
+	return victims
+}
+
+// evictFiles removes the files at paths with their sidecars and variants,
+// and drops them from the caches of the server.
+func (ci *CacheIndex) evictFiles(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	suffixes := append([]string{""}, companionSuffixes()...)
+	ci.mu.Lock()
+	invalidate := ci.invalidate
+	ci.mu.Unlock()
+	for _, p := range paths {
+		for _, suffix := range suffixes {
+			os.Remove(p + suffix)
+			if invalidate != nil {
+				invalidate(p + suffix)
+			}
+		}
+	}
+}
+
+func (ci *CacheIndex) setInvalidate(fn func(path string)) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.invalidate = fn
+}
+
+// Usage returns the bytes used in total and by each bindname, sidecars and
+// variants included.
+func (ci *CacheIndex) Usage() (total int64, byBindName map[string]int64) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	byBindName = make(map[string]int64, len(ci.bindTotals))
+	for k, v := range ci.bindTotals {
+		byBindName[k] = v
+	}
+	return ci.total, byBindName
+}
+
+// Entry returns what the index knows about the file at path.
+func (ci *CacheIndex) Entry(path string) (CacheEntry, bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	it, ok := ci.items[path]
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return it.CacheEntry, true
+}
+
+// Save persists the index if it changed since it was last saved.
+func (ci *CacheIndex) Save() error {
+	ci.mu.Lock()
+	if !ci.dirty {
+		ci.mu.Unlock()
+		return nil
+	}
+	entries := make([]CacheEntry, 0, len(ci.items))
+	for _, it := range ci.items {
+		entries = append(entries, it.CacheEntry)
+	}
+	ci.dirty = false
+	ci.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFileAtomic(ci.path, data)
+	}
+	if err != nil {
+		ci.mu.Lock()
+		ci.dirty = true
+		ci.mu.Unlock()
+	}
+	return err
+}
+
+// StartAutoSave saves the index every interval and once more when ctx is
+// done. Save errors are passed to onError if it is not nil.
+func (ci *CacheIndex) StartAutoSave(ctx context.Context, interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := ci.Save(); err != nil && onError != nil {
+					onError(err)
+				}
+				return
+			case <-ticker.C:
+				if err := ci.Save(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// SetCacheIndex makes FileWithPause record every file it serves, and every
+// file it fetches from an origin, in ci. A nil ci stops the recording.
+func (hs *HttpServer) SetCacheIndex(ci *CacheIndex) {
+	hs.originMu.Lock()
+	defer hs.originMu.Unlock()
+	if old := hs.cacheIndex; old != nil && old != ci {
+		old.setInvalidate(nil)
+	}
+	hs.cacheIndex = ci
+	if ci != nil {
+		ci.setInvalidate(hs.invalidateFile)
+	}
+}
+
+func (hs *HttpServer) GetCacheIndex() *CacheIndex {
+	hs.originMu.RLock()
+	defer hs.originMu.RUnlock()
+	return hs.cacheIndex
+}
+
+// An evictionQueue orders cached files by how soon they are evicted.
+type evictionQueue interface {
+	add(it *cacheItem)
+	// update moves it after its LastAccess or Hits changed.
+	update(it *cacheItem)
+	remove(it *cacheItem)
+	len() int
+	// victim returns the file to evict first other than keep, or nil.
+	victim(keep *cacheItem) *cacheItem
+}
+
+// queuePos is the position of a cacheItem in an lruQueue or lfuQueue.
+type queuePos struct {
+	elem  *list.Element
+	index int
+}
+
+// An lruQueue evicts the least recently served file first. slot is the
+// position of the queue in cacheItem.pos.
+type lruQueue struct {
+	slot int
+	l    *list.List
+}
+
+func (q *lruQueue) add(it *cacheItem)    { it.pos[q.slot].elem = q.l.PushFront(it) }
+func (q *lruQueue) update(it *cacheItem) { q.l.MoveToFront(it.pos[q.slot].elem) }
+func (q *lruQueue) remove(it *cacheItem) { q.l.Remove(it.pos[q.slot].elem) }
+func (q *lruQueue) len() int             { return q.l.Len() }
+
+func (q *lruQueue) victim(keep *cacheItem) *cacheItem {
+	for el := q.l.Back(); el != nil; el = el.Prev() {
+		if it := el.Value.(*cacheItem); it != keep {
+			return it
+		}
+	}
+	return nil
+}
+
+// An lfuQueue evicts the least often served file first, the least recently
+// served of them on a tie. It is a heap.
+type lfuQueue struct {
+	slot  int
+	items []*cacheItem
+}
+
+func (q *lfuQueue) Len() int { return len(q.items) }
+
+func (q *lfuQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+func (q *lfuQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].pos[q.slot].index = i
+	q.items[j].pos[q.slot].index = j
+}
+
+func (q *lfuQueue) Push(x interface{}) {
+	it := x.(*cacheItem)
+	it.pos[q.slot].index = len(q.items)
+	q.items = append(q.items, it)
+}
+
+func (q *lfuQueue) Pop() interface{} {
+	it := q.items[len(q.items)-1]
+	q.items[len(q.items)-1] = nil
+	q.items = q.items[:len(q.items)-1]
+	return it
+}
+
+func (q *lfuQueue) add(it *cacheItem)    { heap.Push(q, it) }
+func (q *lfuQueue) update(it *cacheItem) { heap.Fix(q, it.pos[q.slot].index) }
+func (q *lfuQueue) remove(it *cacheItem) { heap.Remove(q, it.pos[q.slot].index) }
+func (q *lfuQueue) len() int             { return len(q.items) }
+
+func (q *lfuQueue) victim(keep *cacheItem) *cacheItem {
+	if len(q.items) == 0 {
+		return nil
+	}
+	if q.items[0] != keep {
+		return q.items[0]
+	}
+	// the next one is a child of the root
+	var next *cacheItem
+	for i := 1; i <= 2 && i < len(q.items); i++ {
+		if next == nil || q.Less(i, next.pos[q.slot].index) {
+			next = q.items[i]
+		}
+	}
+	return next
+}
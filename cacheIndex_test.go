@@ -0,0 +1,137 @@
+package MesonTerminalEchoServer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCacheFiles writes each named file of size bytes, and a 50 byte
+// sidecar for the names ending in "+header", below root.
+func writeCacheFiles(t *testing.T, root string, size int, names ...string) map[string]string {
+	paths := map[string]string{}
+	for _, name := range names {
+		base := strings.TrimSuffix(name, "+header")
+		p := filepath.Join(root, base)
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if base != name {
+			os.WriteFile(p+HeaderSuffix, make([]byte, 50), 0644)
+		}
+		paths[base] = p
+	}
+	return paths
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestCacheIndexCountsSidecars(t *testing.T) {
+	root := t.TempDir()
+	p := writeCacheFiles(t, root, 100, "a+header", "b+header")
+	ci, err := NewCacheIndex(filepath.Join(root, "index.json"), EvictLRU, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci.Touch(p["a"], "x", 100)
+	if total, _ := ci.Usage(); total != 150 {
+		t.Errorf("usage %d, want 150", total)
+	}
+	ci.SetNodeQuota(250)
+	ci.Touch(p["b"], "x", 100)
+	if exists(p["a"]) || exists(p["a"]+HeaderSuffix) || !exists(p["b"]) {
+		t.Error("a and its sidecar should have been evicted for b")
+	}
+	if total, byBind := ci.Usage(); total != 150 || byBind["x"] != 150 {
+		t.Errorf("usage %d %v, want 150", total, byBind)
+	}
+}
+
+func TestCacheIndexEvictionOrder(t *testing.T) {
+	tests := []struct {
+		policy  EvictionPolicy
+		touches []string
+		evicted string
+	}{
+		{EvictLRU, []string{"a", "b", "c", "a", "d"}, "b"},
+		{EvictLFU, []string{"a", "a", "b", "c", "c", "d"}, "b"},
+		// the file just served is never the victim, even with the fewest hits
+		{EvictLFU, []string{"a", "a", "b", "b", "c", "c", "d"}, "a"},
+	}
+	for _, tt := range tests {
+		root := t.TempDir()
+		p := writeCacheFiles(t, root, 100, "a", "b", "c", "d")
+		ci, err := NewCacheIndex(filepath.Join(root, "index.json"), tt.policy, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range tt.touches {
+			ci.Touch(p[name], "", 100)
+		}
+		for name, path := range p {
+			if exists(path) == (name == tt.evicted) {
+				t.Errorf("policy %d %v: %s exists %v", tt.policy, tt.touches, name, exists(path))
+			}
+		}
+	}
+}
+
+func TestCacheIndexBindNameQuota(t *testing.T) {
+	root := t.TempDir()
+	p := writeCacheFiles(t, root, 100, "x1", "y1", "x2")
+	ci, err := NewCacheIndex(filepath.Join(root, "index.json"), EvictLRU, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci.SetBindNameQuota("x", 150)
+	ci.Touch(p["x1"], "x", 100)
+	ci.Touch(p["y1"], "y", 100)
+	ci.Touch(p["x2"], "x", 100)
+	if exists(p["x1"]) || !exists(p["y1"]) || !exists(p["x2"]) {
+		t.Error("only the older file of x should have been evicted")
+	}
+
+	// reloaded, the order and sizes survive
+	if err := ci.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ci, err = NewCacheIndex(filepath.Join(root, "index.json"), EvictLRU, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci.SetNodeQuota(100)
+	if exists(p["y1"]) || !exists(p["x2"]) {
+		t.Error("the reloaded index should evict the older y1 first")
+	}
+}
+
+func TestCacheIndexEvictionForgetsDigests(t *testing.T) {
+	root := t.TempDir()
+	p := writeCacheFiles(t, root, 100, "a")
+	hs := New()
+	store, err := NewHashStore(filepath.Join(root, "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetHashStore(store)
+	ci, err := NewCacheIndex(filepath.Join(root, "index.json"), EvictLRU, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetCacheIndex(ci)
+	if _, err := store.Record(p["a"]); err != nil {
+		t.Fatal(err)
+	}
+	ci.Touch(p["a"], "", 100)
+	ci.Evict(p["a"])
+	store.mu.Lock()
+	_, ok := store.records[p["a"]]
+	store.mu.Unlock()
+	if ok || exists(p["a"]+DigestSuffix) {
+		t.Error("digest record of the evicted file kept")
+	}
+}
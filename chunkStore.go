@@ -0,0 +1,396 @@
+package MesonTerminalEchoServer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultChunkSize is the chunk size of a ChunkStore created with size 0.
+const DefaultChunkSize = 4 << 20
+
+// A ChunkStore is a FileSystem that stores each object as fixed-size chunks
+// named by their SHA-256 plus a manifest listing them. Identical chunks are
+// stored once, whichever objects and bindnames they belong to. Objects are
+// named by slash-separated paths, such as "bindname/video/a.mp4".
+//
+// On disk, root holds chunks/ab/abcdef... and manifests/<object name>.
+type ChunkStore struct {
+	root      string
+	chunkSize int64
+
+	// mu keeps GC from sweeping chunks written by a Put whose manifest
+	// isn't stored yet, or of an object being opened.
+	mu sync.RWMutex
+
+	// refs counts the open files of each chunk, which GC keeps even once
+	// their object is removed.
+	refMu sync.Mutex
+	refs  map[string]int
+}
+
+// A ChunkManifest describes an object of a ChunkStore.
+type ChunkManifest struct {
+	Version   int       `json:"version"`
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunk_size"`
+	ModTime   time.Time `json:"mtime"`
+	// ContentHash is the hash of the whole object as "sha256:hex".
+	ContentHash string `json:"content_hash"`
+	// Chunks are the hex SHA-256 hashes of the chunks in order.
+	Chunks []string `json:"chunks"`
+}
+
+// NewChunkStore opens or creates a chunk store in root. chunkSize only
+// applies to objects stored from now on; 0 means DefaultChunkSize.
+func NewChunkStore(root string, chunkSize int64) (*ChunkStore, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	for _, dir := range []string{"chunks", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &ChunkStore{root: root, chunkSize: chunkSize, refs: map[string]int{}}, nil
+}
+
+func (s *ChunkStore) chunkPath(sum string) string {
+	return filepath.Join(s.root, "chunks", sum[:2], sum)
+}
+
+func (s *ChunkStore) manifestPath(name string) string {
+	return filepath.Join(s.root, "manifests", filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Put stores the content of r as the object name, replacing any earlier
+// object of that name.
+func (s *ChunkStore) Put(name string, r io.Reader, modTime time.Time) (*ChunkManifest, error) {
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if clean == "" {
+		return nil, fmt.Errorf("chunk store: invalid object name %q", name)
+	}
+	for _, elem := range strings.Split(clean, "/") {
+		if isTempPath(elem) {
+			// would be taken for a manifest being written
+			return nil, fmt.Errorf("chunk store: invalid object name %q", name)
+		}
+	}
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m := &ChunkManifest{Version: 1, ChunkSize: s.chunkSize, ModTime: modTime}
+	whole := sha256.New()
+	buf := make([]byte, s.chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk := buf[:n]
+			whole.Write(chunk)
+			sum := sha256.Sum256(chunk)
+			hexSum := hex.EncodeToString(sum[:])
+			if err := s.putChunk(hexSum, chunk); err != nil {
+				return nil, err
+			}
+			m.Chunks = append(m.Chunks, hexSum)
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.ContentHash = "sha256:" + hex.EncodeToString(whole.Sum(nil))
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	p := s.manifestPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	return m, writeFileAtomic(p, data)
+}
+
+// putChunk stores chunk unless a chunk with its hash exists.
+func (s *ChunkStore) putChunk(sum string, chunk []byte) error {
+	p := s.chunkPath(sum)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, chunk)
+}
+
+// Manifest returns the manifest of the object name.
+func (s *ChunkStore) Manifest(name string) (*ChunkManifest, error) {
+	return readManifest(s.manifestPath(name))
+}
+
+func readManifest(p string) (*ChunkManifest, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	m := &ChunkManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	if m.Version != 1 || m.ChunkSize <= 0 || int64(len(m.Chunks)) != (m.Size+m.ChunkSize-1)/m.ChunkSize {
+		return nil, fmt.Errorf("%s: malformed chunk manifest", p)
+	}
+	return m, nil
+}
+
+// Remove removes the object name. Its chunks stay until GC finds them
+// unused, and open files of it keep reading them.
+func (s *ChunkStore) Remove(name string) error {
+	return os.Remove(s.manifestPath(name))
+}
+
+// GC removes the chunks no manifest or open file refers to and reports how
+// many chunks and bytes it freed.
+func (s *ChunkStore) GC() (removed int, freed int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := map[string]bool{}
+	err = filepath.Walk(filepath.Join(s.root, "manifests"), func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || isTempPath(p) {
+			return err
+		}
+		m, err := readManifest(p)
+		if err != nil {
+			// a chunk of an unreadable manifest can't be told from garbage
+			return err
+		}
+		for _, sum := range m.Chunks {
+			used[sum] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	s.refMu.Lock()
+	for sum := range s.refs {
+		used[sum] = true
+	}
+	s.refMu.Unlock()
+	err = filepath.Walk(filepath.Join(s.root, "chunks"), func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || used[fi.Name()] {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// Open implements FileSystem. Objects open as files reading across their
+// chunks; the directories of object names open as directories.
+func (s *ChunkStore) Open(name string) (File, error) {
+	p := s.manifestPath(name)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, mapOpenError(err, p, filepath.Separator, os.Stat)
+	}
+	if fi.IsDir() {
+		return &chunkDir{store: s, dir: p, info: fi}, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := readManifest(p)
+	if err != nil {
+		return nil, err
+	}
+	s.ref(m.Chunks, 1)
+	return &chunkFile{store: s, m: m, info: chunkInfo{name: fi.Name(), m: m}}, nil
+}
+
+// ref adds delta to the open files of each chunk of sums.
+func (s *ChunkStore) ref(sums []string, delta int) {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	for _, sum := range sums {
+		if s.refs[sum] += delta; s.refs[sum] <= 0 {
+			delete(s.refs, sum)
+		}
+	}
+}
+
+// A chunkFile reads an object across its chunks.
+type chunkFile struct {
+	store *ChunkStore
+	m     *ChunkManifest
+	info  chunkInfo
+	off   int64
+
+	// cur is the open chunk with index curIdx.
+	cur    *os.File
+	curIdx int
+	closed bool
+}
+
+var errChunkSize = errors.New("chunk store: chunk has the wrong size")
+
+func (f *chunkFile) Read(p []byte) (int, error) {
+	if f.off >= f.m.Size {
+		return 0, io.EOF
+	}
+	idx := int(f.off / f.m.ChunkSize)
+	if f.cur == nil || f.curIdx != idx {
+		if f.cur != nil {
+			f.cur.Close()
+			f.cur = nil
+		}
+		c, err := os.Open(f.store.chunkPath(f.m.Chunks[idx]))
+		if err != nil {
+			return 0, err
+		}
+		f.cur, f.curIdx = c, idx
+	}
+	chunkOff := f.off - int64(idx)*f.m.ChunkSize
+	if rest := f.m.ChunkSize - chunkOff; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	if rest := f.m.Size - f.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := f.cur.ReadAt(p, chunkOff)
+	f.off += int64(n)
+	if err == io.EOF {
+		if n < len(p) {
+			return n, errChunkSize
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (f *chunkFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.m.Size
+	default:
+		return 0, errors.New("chunk store: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("chunk store: negative position")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *chunkFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.store.ref(f.m.Chunks, -1)
+	if f.cur != nil {
+		return f.cur.Close()
+	}
+	return nil
+}
+
+func (f *chunkFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *chunkFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.info.name, Err: errors.New("not a directory")}
+}
+
+type chunkInfo struct {
+	name string
+	m    *ChunkManifest
+}
+
+func (fi chunkInfo) Name() string       { return fi.name }
+func (fi chunkInfo) Size() int64        { return fi.m.Size }
+func (fi chunkInfo) Mode() fs.FileMode  { return 0444 }
+func (fi chunkInfo) ModTime() time.Time { return fi.m.ModTime }
+func (fi chunkInfo) IsDir() bool        { return false }
+
+// Sys returns the *ChunkManifest of the object.
+func (fi chunkInfo) Sys() interface{} { return fi.m }
+
+// A chunkDir lists the objects and directories below a directory of
+// object names.
+type chunkDir struct {
+	store   *ChunkStore
+	dir     string
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	read    bool
+}
+
+func (d *chunkDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *chunkDir) Seek(int64, int) (int64, error) { return 0, nil }
+func (d *chunkDir) Close() error                   { return nil }
+func (d *chunkDir) Stat() (fs.FileInfo, error)     { return d.info, nil }
+
+func (d *chunkDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.read {
+		d.read = true
+		ents, err := os.ReadDir(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			if isTempPath(e.Name()) {
+				continue
+			}
+			if e.IsDir() {
+				if fi, err := e.Info(); err == nil {
+					d.entries = append(d.entries, fi)
+				}
+				continue
+			}
+			if m, err := readManifest(filepath.Join(d.dir, e.Name())); err == nil {
+				d.entries = append(d.entries, chunkInfo{name: e.Name(), m: m})
+			}
+		}
+	}
+	if count <= 0 {
+		list := d.entries
+		d.entries = nil
+		return list, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	list := d.entries[:count]
+	d.entries = d.entries[count:]
+	return list, nil
+}
@@ -0,0 +1,109 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestChunkStoreGCKeepsSidecarNamedObjects(t *testing.T) {
+	s, err := NewChunkStore(t.TempDir(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string][]byte{
+		"b/movie.header": []byte("header-named object"),
+		"b/movie.digest": []byte("digest-named object"),
+		"b/movie.parts":  []byte("parts-named object!"),
+	}
+	for name, content := range data {
+		if _, err := s.Put(name, bytes.NewReader(content), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Put("b/gone", bytes.NewReader([]byte("only in a removed object")), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("b/gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, _, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("GC removed %d chunks, want the 3 of the removed object", removed)
+	}
+	for name, content := range data {
+		f, err := s.Open(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: read %q, %v; want %q", name, got, err, content)
+		}
+	}
+}
+
+func TestChunkStorePutRejectsTempNames(t *testing.T) {
+	s, err := NewChunkStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "/", "b/.x.tmp123", ".a.tmp7/x"} {
+		if _, err := s.Put(name, bytes.NewReader([]byte("x")), time.Time{}); err == nil {
+			t.Errorf("Put(%q) succeeded", name)
+		}
+	}
+}
+
+func TestIsTempPath(t *testing.T) {
+	tests := map[string]bool{
+		"dir/.a.jpg.tmp123": true,
+		".a.tmp1":           true,
+		".a.tmp":            false,
+		".a.tmpx1":          false,
+		".tmp12":            false,
+		".config.tmpl":      false,
+		".a.tmp.header":     false,
+		"a.jpg.tmp123":      false,
+	}
+	for path, want := range tests {
+		if got := isTempPath(path); got != want {
+			t.Errorf("isTempPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestChunkStoreGCKeepsChunksOfOpenFiles(t *testing.T) {
+	s, err := NewChunkStore(t.TempDir(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("read after the object was removed")
+	if _, err := s.Put("b/obj", bytes.NewReader(content), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Open("b/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("b/obj"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _, err := s.GC(); err != nil || removed != 0 {
+		t.Fatalf("GC removed %d chunks of an open file, %v", removed, err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("read %q, %v; want %q", got, err, content)
+	}
+	f.Close()
+	if removed, _, err := s.GC(); err != nil || removed != 5 {
+		t.Errorf("GC removed %d chunks after Close, %v; want 5", removed, err)
+	}
+}
@@ -0,0 +1,309 @@
+package MesonTerminalEchoServer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// An EncoderFunc returns a writer that compresses into w. Closing it must
+// flush the compressed stream but not close w.
+type EncoderFunc func(w io.Writer) (io.WriteCloser, error)
+
+var encoders = map[string]EncoderFunc{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+}
+
+// RegisterEncoder makes the content coding encoding available for on-the-fly
+// compression, with ext as the extension of its stored variants. gzip is
+// built in; brotli and zstd encoders can be registered from third party
+// packages, for example:
+//
+//	EchoServer.RegisterEncoder("br", ".br", func(w io.Writer) (io.WriteCloser, error) {
+//		return brotli.NewWriter(w), nil
+//	})
+func RegisterEncoder(encoding, ext string, fn EncoderFunc) {
+	encoding = strings.ToLower(encoding)
+	encodingMu.Lock()
+	defer encodingMu.Unlock()
+	encoders[encoding] = fn
+	encodingExt[encoding] = ext
+}
+
+func encoder(encoding string) (EncoderFunc, bool) {
+	encodingMu.RLock()
+	defer encodingMu.RUnlock()
+	fn, ok := encoders[encoding]
+	return fn, ok
+}
+
+// CompressionConfig controls the on-the-fly compression of files served by
+// FileWithPause and ServeFile. Files are only compressed if there is no
+// precompressed variant for the client.
+type CompressionConfig struct {
+	// Encodings are the content codings to compress with, in the order the
+	// server prefers them. Each needs an encoder. Default gzip.
+	Encodings []string
+	// MinSize is the smallest file compressed, in bytes. Default 1KB.
+	MinSize int64
+	// MIMETypes are path.Match patterns for the media types compressed.
+	// Default text/*, application/javascript, application/json,
+	// application/xml and image/svg+xml.
+	MIMETypes []string
+	// Persist stores the compressed body next to the file, as for
+	// precompressed variants, so later requests are served from disk with
+	// ranges and a Content-Length. The variant is written in the background
+	// after the first GET answered with the whole file; until it exists,
+	// or if storing fails, the body is compressed while it is sent and
+	// Range requests get the whole body.
+	Persist bool
+	// MaxPersistSize is the largest file whose compressed body is stored.
+	// Larger files are always compressed while they are sent. Default 64MB.
+	MaxPersistSize int64
+}
+
+const (
+	defaultCompressMinSize     = 1024
+	defaultCompressPersistSize = 64 << 20
+)
+
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// SetCompression turns on-the-fly compression on with cfg, or off for a nil
+// cfg. It is off by default.
+func (hs *HttpServer) SetCompression(cfg *CompressionConfig) error {
+	var c *CompressionConfig
+	if cfg != nil {
+		c = &CompressionConfig{
+			MinSize:        cfg.MinSize,
+			MIMETypes:      append([]string(nil), cfg.MIMETypes...),
+			Persist:        cfg.Persist,
+			MaxPersistSize: cfg.MaxPersistSize,
+		}
+		for _, enc := range cfg.Encodings {
+			enc = strings.ToLower(enc)
+			if _, ok := encoder(enc); !ok {
+				return fmt.Errorf("no encoder for content coding %q", enc)
+			}
+			c.Encodings = append(c.Encodings, enc)
+		}
+		if len(c.Encodings) == 0 {
+			c.Encodings = []string{"gzip"}
+		}
+		if c.MinSize <= 0 {
+			c.MinSize = defaultCompressMinSize
+		}
+		if c.MaxPersistSize <= 0 {
+			c.MaxPersistSize = defaultCompressPersistSize
+		}
+		if len(c.MIMETypes) == 0 {
+			c.MIMETypes = defaultCompressTypes
+		}
+		for _, pattern := range c.MIMETypes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad MIME type pattern %q", pattern)
+			}
+		}
+	}
+	hs.encodingMu.Lock()
+	defer hs.encodingMu.Unlock()
+	hs.compression = c
+	return nil
+}
+
+// GetCompression returns the compression config in effect, with defaults
+// filled in, or nil if compression is off.
+func (hs *HttpServer) GetCompression() *CompressionConfig {
+	hs.encodingMu.RLock()
+	defer hs.encodingMu.RUnlock()
+	if hs.compression == nil {
+		return nil
+	}
+	c := *hs.compression
+	c.Encodings = append([]string(nil), c.Encodings...)
+	c.MIMETypes = append([]string(nil), c.MIMETypes...)
+	return &c
+}
+
+func (cfg *CompressionConfig) compressible(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cfg.MIMETypes {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// openCompressed decides whether the response serving the file name in fsys,
+// described by fi, is compressed on the fly. It returns the coding to
+// compress content with while sending, or "" to send it as is, and whether
+// the compressed body should be stored for later requests. Stored variants
+// are served by openPrecompressed.
+func (hs *HttpServer) openCompressed(h http.Header, r *http.Request, fsys FileSystem, name string, fi os.FileInfo, content io.ReadSeeker) (stream string, persist bool) {
+	cfg := hs.GetCompression()
+	if cfg == nil || h.Get("Content-Encoding") != "" || fi.Size() < cfg.MinSize {
+		return "", false
+	}
+	ctype, err := contentType(h, name, content)
+	if err != nil || !cfg.compressible(ctype) {
+		return "", false
+	}
+	addVary(h, "Accept-Encoding")
+	enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+	if enc == "" {
+		return "", false
+	}
+	h.Set("Content-Type", ctype)
+	return enc, cfg.Persist && fi.Size() <= cfg.MaxPersistSize
+}
+
+// persistCompressed stores the variant of the file described by fi in the
+// background, if o compressed it on the fly for storing and the response
+// sent the whole file with status. HEAD requests and conditional hits leave
+// it to a later request. CloseServer stops and waits for it.
+func (hs *HttpServer) persistCompressed(r *http.Request, fi os.FileInfo, o *serveOptions, status int) {
+	if o.persistPath == "" || r.Method != http.MethodGet || status != http.StatusOK {
+		return
+	}
+	hs.background(func() { hs.storeCompressed(o.persistPath, fi, o.compress) })
+}
+
+// storeCompressed compresses the file at filePath, described by fi, into its
+// variant for encoding unless an up to date variant exists. Concurrent
+// requests for the same variant share one compression.
+func (hs *HttpServer) storeCompressed(filePath string, fi os.FileInfo, encoding string) error {
+	ext, _ := encodingExtension(encoding)
+	variant := filePath + ext
+	_, err, _ := hs.compressFlight.do(variant, func() (interface{}, error) {
+		if vfi, err := os.Stat(variant); err == nil && !vfi.ModTime().Before(fi.ModTime()) {
+			return nil, nil
+		}
+		newWriter, _ := encoder(encoding)
+		src, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		err = writeFileAtomicFunc(variant, func(w io.Writer) error {
+			ew, err := newWriter(w)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(ew, &closingReader{r: src, closing: hs.closing}); err != nil {
+				return err
+			}
+			return ew.Close()
+		})
+		if ci := hs.GetCacheIndex(); err == nil && ci != nil {
+			ci.remeasure(filePath)
+		}
+		return nil, err
+	})
+	return err
+}
+
+// closingReader reads r until the server is closing.
+type closingReader struct {
+	r       io.Reader
+	closing <-chan struct{}
+}
+
+func (r *closingReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closing:
+		return 0, ErrServerClosing
+	default:
+		return r.r.Read(p)
+	}
+}
+
+// An encodingReader reads src compressed by a goroutine.
+type encodingReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops the compression and waits until src is no longer read, so
+// src can be closed afterwards.
+func (r *encodingReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+// encodeReader returns a reader of src compressed with encoding. It must be
+// closed before src is.
+func encodeReader(encoding string, src io.Reader) *encodingReader {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newWriter, ok := encoder(encoding)
+		if !ok {
+			pw.CloseWithError(fmt.Errorf("no encoder for content coding %q", encoding))
+			return
+		}
+		ew, err := newWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(ew, src); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(ew.Close())
+	}()
+	return &encodingReader{PipeReader: pr, done: done}
+}
+
+// setStreamEncoding sets the header of a response compressed with encoding
+// while it is sent. Its ETag, if any, becomes weak since the encoded bytes
+// may differ between encoder versions.
+func setStreamEncoding(h http.Header, encoding string) {
+	h.Set("Content-Encoding", encoding)
+	if etag := h.Get("Etag"); strings.HasSuffix(etag, `"`) && len(etag) >= 2 {
+		etag = etag[:len(etag)-1] + "-" + encoding + `"`
+		if !strings.HasPrefix(etag, "W/") {
+			etag = "W/" + etag
+		}
+		h.Set("Etag", etag)
+	}
+}
+
+// contentType returns the Content-Type of h or else the type of the file
+// name, sniffed from content if the extension is unknown. content is
+// rewound after sniffing.
+func contentType(h http.Header, name string, content io.ReadSeeker) (string, error) {
+	if ctypes, haveType := h["Content-Type"]; haveType {
+		if len(ctypes) == 0 {
+			return "", nil
+		}
+		return ctypes[0], nil
+	}
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(content, buf[:])
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
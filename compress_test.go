@@ -0,0 +1,49 @@
+package MesonTerminalEchoServer
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowReader counts its reads, each taking a while.
+type slowReader struct {
+	reads int32
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	time.Sleep(5 * time.Millisecond)
+	return len(p), nil
+}
+
+func TestEncodeReaderCloseWaits(t *testing.T) {
+	src := &slowReader{}
+	r := encodeReader("gzip", src)
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	reads := atomic.LoadInt32(&src.reads)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&src.reads); n != reads {
+		t.Errorf("source read %d times after Close", n-reads)
+	}
+}
+
+func TestCloseServerWaitsForBackground(t *testing.T) {
+	hs := New()
+	var stopped int32
+	hs.background(func() {
+		<-hs.closing
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&stopped, 1)
+	})
+	hs.CloseServer()
+	if atomic.LoadInt32(&stopped) != 1 {
+		t.Error("CloseServer returned before the background work stopped")
+	}
+	hs.background(func() { t.Error("background work started after CloseServer") })
+	hs.bgWG.Wait()
+}
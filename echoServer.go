@@ -1,13 +1,14 @@
 package MesonTerminalEchoServer
 
 import (
-	"bufio"
 	"context"
-	"io"
+	"errors"
 	"net"
+	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -16,11 +17,67 @@ import (
 
 type HttpServer struct {
 	*echo.Echo
+	// PauseMoment is the Unix time the current pause ends, 0 if the server
+	// is not paused. It is updated on every pause and resume.
+	//
+	// Deprecated: setting it has no effect, and reading it races with the
+	// end of a pause; use GetPauseUntil.
 	PauseMoment int64
+
+	pause     *pauseController
+	bandwidth *RateLimiter
+	clients   *clientLimiterPool
+	hooks     transferHooks
+
+	limitMu   sync.Mutex
+	connLimit rateLimit
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	// bgMu orders starting background work against closing
+	bgMu sync.Mutex
+	bgWG sync.WaitGroup
+
+	ruleMu      sync.RWMutex
+	headerRules *HeaderRuleSet
+	nodeID      string
+
+	etagMu      sync.RWMutex
+	hashSource  HashSource
+	hashStore   *HashStore
+	memoryCache *MemoryCache
+	fdCache     *FDCache
+	noAutoETag  bool
+
+	encodingMu     sync.RWMutex
+	encodings      []string
+	compression    *CompressionConfig
+	compressFlight flightGroup
+
+	originMu   sync.RWMutex
+	origins    map[string]*OriginConfig
+	downloads  map[string]*download
+	cacheIndex *CacheIndex
 }
 
+var (
+	// ErrServerClosing is returned for transfers aborted by CloseServer.
+	ErrServerClosing = errors.New("server is closing")
+	// ErrClientGone is returned for transfers aborted because the client
+	// went away.
+	ErrClientGone = errors.New("client disconnected")
+)
+
 func New() (hs *HttpServer) {
-	hs = &HttpServer{echo.New(), 0}
+	hs = &HttpServer{
+		Echo:      echo.New(),
+		bandwidth: NewRateLimiter(0, 0),
+		clients:   newClientLimiterPool(),
+		closing:   make(chan struct{}),
+	}
+	hs.pause = newPauseController(&hs.PauseMoment)
+	// the fd cache sends files straight to the client connection
+	hs.Server.ConnContext = func(ctx context.Context, c net.Conn) context.Context { return withConn(ctx, c) }
 	return hs
 }
 
@@ -29,32 +86,152 @@ func (hs *HttpServer) UseJsoniter() {
 }
 
 func (hs *HttpServer) SetPauseSeconds(secs int64) {
-	hs.PauseMoment = time.Now().Unix() + secs
+	hs.SetPauseDuration(time.Duration(secs) * time.Second)
+}
+
+// SetPauseDuration pauses all in-flight transfers for d from now, replacing
+// any earlier pause. d <= 0 is the same as Resume.
+func (hs *HttpServer) SetPauseDuration(d time.Duration) {
+	hs.pause.pause(d)
+}
+
+// Resume ends the current pause early and wakes all paused transfers.
+func (hs *HttpServer) Resume() {
+	hs.pause.resume()
+}
+
+func (hs *HttpServer) IsPaused() bool {
+	return !hs.GetPauseUntil().IsZero()
+}
+
+// GetPauseUntil returns the moment the current pause ends, or the zero time
+// if the server is not paused.
+func (hs *HttpServer) GetPauseUntil() time.Time {
+	return hs.pause.pausedUntil()
 }
 
 func (hs *HttpServer) GetPauseMoment() int64 {
-	return hs.PauseMoment
+	until := hs.GetPauseUntil()
+	if until.IsZero() {
+		return 0
+	}
+	return until.Unix()
+}
+
+// SetConnectionRateLimit sets the default rate limit of every single
+// transfer. It applies to transfers started after the call.
+// bytesPerSec <= 0 removes the limit.
+func (hs *HttpServer) SetConnectionRateLimit(bytesPerSec, burst int64) {
+	hs.limitMu.Lock()
+	defer hs.limitMu.Unlock()
+	hs.connLimit = rateLimit{bytesPerSec, burst}
+}
+
+func (hs *HttpServer) GetConnectionRateLimit() (bytesPerSec, burst int64) {
+	hs.limitMu.Lock()
+	defer hs.limitMu.Unlock()
+	return hs.connLimit.bytesPerSec, hs.connLimit.burst
+}
+
+// SetClientIPRateLimit caps the combined throughput of all transfers to the
+// same client IP. It takes effect immediately. The client IP is taken from
+// the Echo IPExtractor if one is set, otherwise from the request RemoteAddr.
+// bytesPerSec <= 0 removes the limit.
+func (hs *HttpServer) SetClientIPRateLimit(bytesPerSec, burst int64) {
+	hs.clients.setLimit(bytesPerSec, burst)
+}
+
+func (hs *HttpServer) GetClientIPRateLimit() (bytesPerSec, burst int64) {
+	return hs.clients.limit()
 }
 
-func FileWithPause(hs *HttpServer, c echo.Context, filePath string, header map[string][]string, ignoreHeaderMap map[string]struct{}) (err error) {
-	f, err := os.Open(filePath)
+// FileWithPause serves the file at filePath with the given saved header
+// minus the keys ignored by policy. It reports what was sent to the client; err is
+// non-nil if the file can't be served or the transfer was aborted.
+func FileWithPause(hs *HttpServer, c echo.Context, filePath string, header map[string][]string, policy *HeaderPolicy, opts ...ServeOption) (result TransferResult, err error) {
+	dir, base := filepath.Split(filePath)
+	return fileWithPause(hs, c, Dir(dir), base, filePath, header, policy, opts)
+}
+
+// FileWithPauseFS is like FileWithPause but serves the file name from fsys.
+// Use FS to serve from an io/fs.FS such as an embed.FS or os.DirFS. Files
+// are only checked by the hash store if fsys is a Dir.
+func FileWithPauseFS(hs *HttpServer, c echo.Context, fsys FileSystem, name string, header map[string][]string, policy *HeaderPolicy, opts ...ServeOption) (result TransferResult, err error) {
+	return fileWithPause(hs, c, fsys, name, dirPath(fsys, name), header, policy, opts)
+}
+
+// fileWithPause serves name from fsys. filePath is its path in the native
+// file system, or "" if it has none.
+func fileWithPause(hs *HttpServer, c echo.Context, fsys FileSystem, name, filePath string, header map[string][]string, policy *HeaderPolicy, opts []ServeOption) (result TransferResult, err error) {
+	notFound := TransferResult{StatusCode: http.StatusNotFound, Size: -1}
+	o := newServeOptions(append([]ServeOption{WithHeaderRules(hs.GetHeaderRules())}, opts...))
+	ctx, cancel := hs.transferContext(c.Request().Context())
+	defer cancel()
+	f, err := hs.openFile(ctx, fsys, name)
 	if err != nil {
-		return echo.NotFoundHandler(c)
+		if os.IsNotExist(err) && filePath != "" && o.originPath != "" {
+			cfg := o.origin
+			if cfg == nil {
+				cfg = hs.GetOrigin(o.bindName)
+			}
+			if cfg != nil {
+				return hs.serveFromOrigin(c, cfg, filePath, header, policy, o)
+			}
+		}
+		return notFound, echo.NotFoundHandler(c)
 	}
 	defer f.Close()
-	fi, _ := f.Stat()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return notFound, echo.NotFoundHandler(c)
+	}
 
+	if o.sidecarPath != "" {
+		sc, err := hs.readSidecar(o.sidecarPath, o.sidecarOpts)
+		if err != nil && !os.IsNotExist(err) {
+			c.Logger().Warnf("sidecar %s: %v", o.sidecarPath, err)
+		}
+		o.sidecar = sc
+	}
+	if store := hs.GetHashStore(); store != nil && filePath != "" {
+		rec, err := store.Verify(filePath, fi, sidecarContentHash(o.sidecar, fi))
+		switch {
+		case errors.Is(err, ErrIntegrity):
+			c.Logger().Errorf("quarantined %s: %v", filePath, err)
+			return notFound, echo.NotFoundHandler(c)
+		case err != nil:
+			c.Logger().Warnf("digest %s: %v", filePath, err)
+		default:
+			o.digest = rec
+		}
+	}
+	if ci := hs.GetCacheIndex(); ci != nil && filePath != "" {
+		ci.Touch(filePath, o.bindName, fi.Size())
+	}
+	if o.sidecar != nil {
+		addHeader(c.Response().Header(), o.sidecar.Header, policy)
+	}
+	addHeader(c.Response().Header(), header, policy)
+	hs.setETag(c.Response().Header(), filePath, fi, o.sidecar)
+
+	content, size, release := hs.selectEncoding(c.Response().Header(), c.Request(), fsys, name, fi, f, o)
+	defer release()
+
+	sizeFunc := func() (int64, error) { return size, nil }
+	result = serveContent(hs, c.Response(), c.Request(), fi.Name(), fi.ModTime(), sizeFunc, content, o)
+	hs.persistCompressed(c.Request(), fi, o, result.StatusCode)
+	return result, result.Err
+}
+
+func addHeader(dst http.Header, header map[string][]string, policy *HeaderPolicy) {
 	for headerKey, headerValue := range header {
-		_, exist := ignoreHeaderMap[headerKey]
-		if exist {
+		if policy.Ignored(headerKey) {
 			continue
 		}
 		for _, v := range headerValue {
-			c.Response().Header().Add(headerKey, v)
+			dst.Add(headerKey, v)
 		}
 	}
-	ServeContent(hs, c.Response(), c.Request(), fi.Name(), fi.ModTime(), f)
-	return
 }
 
 //func FileWithPause(hs *HttpServer, c echo.Context, filePath string, needSavedHeader bool, ignoreHeaderMap map[string]struct{}) (err error) {
@@ -85,8 +262,66 @@ func FileWithPause(hs *HttpServer, c echo.Context, filePath string, header map[s
 //	return
 //}
 
+// SetBandwidthLimit caps the combined throughput of all transfers at
+// bytesPerSec with bursts of up to burst bytes. It takes effect immediately,
+// including for transfers already in progress. bytesPerSec <= 0 removes the cap.
+func (hs *HttpServer) SetBandwidthLimit(bytesPerSec, burst int64) {
+	hs.bandwidth.SetLimit(bytesPerSec, burst)
+}
+
+func (hs *HttpServer) GetBandwidthLimit() (bytesPerSec, burst int64) {
+	return hs.bandwidth.Limit()
+}
+
+// CloseServer closes the server and aborts all in-flight transfers,
+// including paused ones.
 func (hs *HttpServer) CloseServer() {
+	hs.closeOnce.Do(func() {
+		hs.bgMu.Lock()
+		close(hs.closing)
+		hs.bgMu.Unlock()
+	})
 	hs.Close()
+	hs.bgWG.Wait()
+}
+
+// background runs fn in a goroutine that CloseServer waits for. fn should
+// stop early once the server is closing. It isn't run if the server is
+// already closing.
+func (hs *HttpServer) background(fn func()) {
+	hs.bgMu.Lock()
+	defer hs.bgMu.Unlock()
+	if hs.isClosing() {
+		return
+	}
+	hs.bgWG.Add(1)
+	go func() {
+		defer hs.bgWG.Done()
+		fn()
+	}()
+}
+
+func (hs *HttpServer) isClosing() bool {
+	select {
+	case <-hs.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// transferContext returns a context that is done when parent is done or
+// the server is closed.
+func (hs *HttpServer) transferContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-hs.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
 
 func (hs *HttpServer) WaitForServerStart(isTLS bool) error {
@@ -116,31 +351,18 @@ func (hs *HttpServer) WaitForServerStart(isTLS bool) error {
 	}
 }
 
-func AddHeader(c echo.Context, filePath string, ignoreHeaderMap map[string]struct{}) error {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	buf := bufio.NewReader(f)
-	for {
-		//key
-		key, _, err := buf.ReadLine()
-		if err != nil {
-			if err == io.EOF { //read end
-				return nil
-			}
-			return err
-		}
-		_, exist := ignoreHeaderMap[string(key)]
-		if exist {
-			continue
-		}
-		//value count
-		countStr, _, err := buf.ReadLine()
-		count, err := strconv.Atoi(string(countStr))
-		for i := 0; i < count; i++ {
-			value, _, _ := buf.ReadLine()
-			c.Response().Header().Add(string(key), string(value))
-		}
-	}
+// AddHeader adds the header stored in the sidecar at filePath, in any of the
+// sidecar formats, to the response, minus the keys ignored by policy. A
+// malformed sidecar adds nothing and its error is returned.
+func AddHeader(c echo.Context, filePath string, policy *HeaderPolicy) error {
+	return AddHeaderWithOptions(c, filePath, policy, HeaderParseOptions{})
+}
+
+// AddHeaderWithOptions is like AddHeader but parses the sidecar with opts.
+// With opts.BestEffort the valid entries of a malformed sidecar are added
+// and the error is still returned.
+func AddHeaderWithOptions(c echo.Context, filePath string, policy *HeaderPolicy, opts HeaderParseOptions) error {
+	header, err := ReadHeaderFileWithOptions(filePath, opts)
+	addHeader(c.Response().Header(), header, policy)
+	return err
 }
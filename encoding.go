@@ -0,0 +1,254 @@
+package MesonTerminalEchoServer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	encodingMu sync.RWMutex
+	// encodingExt maps content codings to the extension of their
+	// precompressed siblings.
+	encodingExt = map[string]string{
+		"br":   ".br",
+		"zstd": ".zst",
+		"gzip": ".gz",
+	}
+)
+
+func encodingExtension(encoding string) (string, bool) {
+	encodingMu.RLock()
+	defer encodingMu.RUnlock()
+	ext, ok := encodingExt[encoding]
+	return ext, ok
+}
+
+// SetPrecompressedEncodings makes FileWithPause and ServeFile look for
+// precompressed siblings of the served file, such as "app.js.br" for
+// "app.js", and serve the best one the client accepts. encodings are
+// content codings in the order the server prefers them, like "br", "zstd",
+// "gzip". No encodings turns the lookup off, which is the default.
+func (hs *HttpServer) SetPrecompressedEncodings(encodings ...string) error {
+	var list []string
+	for _, enc := range encodings {
+		enc = strings.ToLower(enc)
+		if _, ok := encodingExtension(enc); !ok {
+			return fmt.Errorf("unknown content coding %q", enc)
+		}
+		list = append(list, enc)
+	}
+	hs.encodingMu.Lock()
+	defer hs.encodingMu.Unlock()
+	hs.encodings = list
+	return nil
+}
+
+func (hs *HttpServer) GetPrecompressedEncodings() []string {
+	hs.encodingMu.RLock()
+	defer hs.encodingMu.RUnlock()
+	return append([]string(nil), hs.encodings...)
+}
+
+// acceptEncoding is a parsed Accept-Encoding header.
+type acceptEncoding struct {
+	q        map[string]float64
+	wildcard float64 // q of "*", or -1 if absent
+}
+
+func parseAcceptEncoding(s string) acceptEncoding {
+	ae := acceptEncoding{q: map[string]float64{}, wildcard: -1}
+	for _, part := range strings.Split(s, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if len(p) > 2 && (p[0] == 'q' || p[0] == 'Q') && p[1] == '=' {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil || v < 0 || v > 1 {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if coding == "*" {
+			ae.wildcard = q
+		} else {
+			ae.q[coding] = q
+		}
+	}
+	return ae
+}
+
+// quality returns the q value the client gives coding.
+func (ae acceptEncoding) quality(coding string) float64 {
+	if q, ok := ae.q[coding]; ok {
+		return q
+	}
+	if ae.wildcard >= 0 {
+		return ae.wildcard
+	}
+	if coding == "identity" {
+		// identity is acceptable unless excluded
+		return 1
+	}
+	return 0
+}
+
+// negotiateEncoding picks the coding from available, in server preference
+// order, that the client given by the Accept-Encoding header s prefers. It
+// returns "" for identity.
+func negotiateEncoding(s string, available []string) string {
+	if s == "" || len(available) == 0 {
+		return ""
+	}
+	ae := parseAcceptEncoding(s)
+	best, bestQ := "", 0.0
+	for _, coding := range available {
+		if q := ae.quality(coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	if best == "" || ae.quality("identity") > bestQ {
+		return ""
+	}
+	return best
+}
+
+// An encodedVariant is a precompressed sibling of a served file.
+type encodedVariant struct {
+	encoding string
+	file     File
+	fi       os.FileInfo
+}
+
+// openPrecompressed looks for precompressed siblings of the file name in
+// fsys, described by fi, and opens the one r accepts best. It sets Vary if
+// the response depends on Accept-Encoding and returns nil if the original
+// should be served. A sibling older than the original is ignored as stale.
+func (hs *HttpServer) openPrecompressed(h http.Header, r *http.Request, fsys FileSystem, name string, fi os.FileInfo) *encodedVariant {
+	encodings := hs.GetPrecompressedEncodings()
+	if cfg := hs.GetCompression(); cfg != nil && cfg.Persist {
+		// variants stored by on-the-fly compression
+		for _, enc := range cfg.Encodings {
+			if !containsString(encodings, enc) {
+				encodings = append(encodings, enc)
+			}
+		}
+	}
+	if len(encodings) == 0 || h.Get("Content-Encoding") != "" {
+		// a body stored encoded can't be encoded again
+		return nil
+	}
+	var available []string
+	for _, enc := range encodings {
+		ext, _ := encodingExtension(enc)
+		vfi, err := statFS(fsys, name+ext)
+		if err != nil || !vfi.Mode().IsRegular() || vfi.ModTime().Before(fi.ModTime()) {
+			continue
+		}
+		available = append(available, enc)
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	addVary(h, "Accept-Encoding")
+
+	enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), available)
+	if enc == "" {
+		return nil
+	}
+	ext, _ := encodingExtension(enc)
+	f, err := fsys.Open(name + ext)
+	if err != nil {
+		return nil
+	}
+	vfi, err := f.Stat()
+	if err != nil || !vfi.Mode().IsRegular() {
+		f.Close()
+		return nil
+	}
+	return &encodedVariant{encoding: enc, file: f, fi: vfi}
+}
+
+// statFS stats name in fsys.
+func statFS(fsys FileSystem, name string) (os.FileInfo, error) {
+	if filePath := dirPath(fsys, name); filePath != "" {
+		return os.Stat(filePath)
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// apply sets the header of a response serving v instead of original, which
+// is used to find the content type. The ETag, if any, gets the coding as a
+// suffix since each encoding is a separate representation.
+func (v *encodedVariant) apply(h http.Header, name string, original io.ReadSeeker) {
+	if _, haveType := h["Content-Type"]; !haveType {
+		if ctype, err := contentType(h, name, original); err == nil {
+			h.Set("Content-Type", ctype)
+		}
+	}
+	h.Set("Content-Encoding", v.encoding)
+	if etag := h.Get("Etag"); strings.HasSuffix(etag, `"`) && len(etag) >= 2 {
+		h.Set("Etag", etag[:len(etag)-1]+"-"+v.encoding+`"`)
+	}
+}
+
+// selectEncoding picks the representation of the file name in fsys,
+// described by fi and opened as f, to send for r: a precompressed variant,
+// f compressed on the fly or f itself. It sets up the header and o for it
+// and returns the content to serve, its size and a func releasing it.
+func (hs *HttpServer) selectEncoding(h http.Header, r *http.Request, fsys FileSystem, name string, fi os.FileInfo, f io.ReadSeeker, o *serveOptions) (content io.ReadSeeker, size int64, release func()) {
+	v := hs.openPrecompressed(h, r, fsys, name, fi)
+	if v == nil {
+		if stream, persist := hs.openCompressed(h, r, fsys, name, fi, f); stream != "" {
+			setStreamEncoding(h, stream)
+			o.compress = stream
+			if persist {
+				o.persistPath = dirPath(fsys, name)
+			}
+		}
+		return f, fi.Size(), func() {}
+	}
+	v.apply(h, fi.Name(), f)
+	o.encoding = v.encoding
+	return v.file, v.fi.Size(), func() { v.file.Close() }
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package MesonTerminalEchoServer
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A HashSource knows the content hashes of files, such as a hash cache.
+type HashSource interface {
+	// ContentHash returns the hash of the file at path as "algorithm:hex"
+	// if it is known for the file as described by fi.
+	ContentHash(path string, fi os.FileInfo) (hash string, ok bool)
+}
+
+// SetHashSource sets where generated ETags look up content hashes. A nil
+// src leaves them to the sidecar and file metadata.
+func (hs *HttpServer) SetHashSource(src HashSource) {
+	hs.etagMu.Lock()
+	defer hs.etagMu.Unlock()
+	hs.hashSource = src
+}
+
+func (hs *HttpServer) GetHashSource() HashSource {
+	hs.etagMu.RLock()
+	defer hs.etagMu.RUnlock()
+	return hs.hashSource
+}
+
+// SetAutoETag turns the generation of ETags for responses without one on
+// or off. It is on by default.
+func (hs *HttpServer) SetAutoETag(enabled bool) {
+	hs.etagMu.Lock()
+	defer hs.etagMu.Unlock()
+	hs.noAutoETag = !enabled
+}
+
+func (hs *HttpServer) GetAutoETag() bool {
+	hs.etagMu.RLock()
+	defer hs.etagMu.RUnlock()
+	return !hs.noAutoETag
+}
+
+// setETag sets a generated strong ETag on h unless it already has one.
+// path and sc may be empty.
+func (hs *HttpServer) setETag(h http.Header, path string, fi os.FileInfo, sc *Sidecar) {
+	if fi == nil || h.Get("Etag") != "" || !hs.GetAutoETag() {
+		return
+	}
+	if etag := hs.fileETag(path, fi, sc); etag != "" {
+		h.Set("Etag", etag)
+	}
+}
+
+// fileETag returns a strong ETag for the file. It is derived from the
+// content hash if one is known, from the sidecar or the hash source, and
+// from the modification time, size and inode otherwise.
+func (hs *HttpServer) fileETag(path string, fi os.FileInfo, sc *Sidecar) string {
+	if hash := hs.contentHash(path, fi, sc); hash != "" {
+		return `"` + etagSafe(hash) + `"`
+	}
+	etag := strconv.FormatInt(fi.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(fi.Size(), 16)
+	if ino, ok := fileInode(fi); ok {
+		etag += "-" + strconv.FormatUint(ino, 16)
+	}
+	return `"` + etag + `"`
+}
+
+// contentHash returns the known content hash of the file, or "".
+func (hs *HttpServer) contentHash(path string, fi os.FileInfo, sc *Sidecar) string {
+	if hash := sidecarContentHash(sc, fi); hash != "" {
+		return hash
+	}
+	if src := hs.GetHashSource(); src != nil && path != "" {
+		if hash, ok := src.ContentHash(path, fi); ok {
+			return hash
+		}
+	}
+	return ""
+}
+
+// sidecarContentHash returns the content hash stored in sc if it still
+// describes the file as given by fi, or "". That is the case if the size
+// agrees and the file wasn't modified after it was fetched; a file rewritten
+// in place with the same size has a later modification time.
+func sidecarContentHash(sc *Sidecar, fi os.FileInfo) string {
+	if sc == nil || sc.ContentHash == "" || sc.FetchedAt == nil {
+		return ""
+	}
+	if sc.Size >= 0 && sc.Size != fi.Size() || fi.ModTime().After(*sc.FetchedAt) {
+		return ""
+	}
+	return sc.ContentHash
+}
+
+// etagSafe turns a content hash such as "sha256:9f86..." into valid ETag
+// characters.
+func etagSafe(hash string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r < 0x21 || r == 0x7f {
+			return -1
+		}
+		if r == ':' {
+			return '-'
+		}
+		return r
+	}, hash)
+}
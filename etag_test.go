@@ -0,0 +1,39 @@
+package MesonTerminalEchoServer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileETagSidecarHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2021, 9, 13, 18, 0, 0, 0, time.UTC)
+	os.Chtimes(path, modTime, modTime)
+	fi, _ := os.Stat(path)
+	hs := New()
+	hash := sha256Hash("content")
+	strong := `"` + etagSafe(hash) + `"`
+
+	fetched := modTime.Add(time.Minute)
+	sc := &Sidecar{ContentHash: hash, Size: fi.Size(), FetchedAt: &fetched}
+	if got := hs.fileETag(path, fi, sc); got != strong {
+		t.Errorf("fetched after the change: ETag %s, want %s", got, strong)
+	}
+
+	// rewritten in place with the same size after the fetch
+	rewritten := fetched.Add(time.Minute)
+	os.WriteFile(path, []byte("CONTENT"), 0644)
+	os.Chtimes(path, rewritten, rewritten)
+	fi, _ = os.Stat(path)
+	if got := hs.fileETag(path, fi, sc); got == strong {
+		t.Errorf("same-size rewrite keeps the sidecar ETag %s", got)
+	}
+	if got := hs.fileETag(path, fi, &Sidecar{ContentHash: hash, Size: fi.Size()}); got == strong {
+		t.Errorf("sidecar without fetch time gives ETag %s", got)
+	}
+}
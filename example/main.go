@@ -1,14 +1,10 @@
 package main
 
 import (
-	"bufio"
-	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
 	"time"
 
 	EchoServer "github.com/daqnext/MesonTerminalEchoServer"
@@ -24,55 +20,29 @@ type testStruct struct {
 	Somefloat  float64 `json:"somefloat"`
 }
 
-func readHeader(filePath string) (map[string][]string, error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	buf := bufio.NewReader(f)
-	header := map[string][]string{}
-	for {
-		//key
-		key, _, err := buf.ReadLine()
-		if err != nil {
-			if err == io.EOF { //read end
-				return header, nil
-			}
-			return nil, err
-		}
-		//value count
-		countStr, _, err := buf.ReadLine()
-		count, err := strconv.Atoi(string(countStr))
-		if count <= 0 {
-			continue
-		}
-		header[string(key)] = []string{}
-		for i := 0; i < count; i++ {
-			value, _, _ := buf.ReadLine()
-			header[string(key)] = append(header[string(key)], string(value))
-		}
-	}
-}
-
 func main() {
 	logger, _ := LogrusULog.New("./logs", 2, 20, 30)
 	logger.SetLevel(ULog.InfoLevel)
 
-	var IgnoreHeader = map[string]struct{}{
-		"Content-Length":              {},
-		"Connection":                  {},
-		"Server":                      {},
-		"Last-Modified":               {},
-		"Expires":                     {},
-		"Access-Control-Allow-Origin": {},
-		"Allow":                       {},
-		"Content-Encoding":            {},
-	}
+	var IgnoreHeader = EchoServer.NewHeaderPolicy(
+		"Content-Length",
+		"Connection",
+		"Server",
+		"Last-Modified",
+		"Expires",
+		"Access-Control-Allow-Origin",
+		"Allow",
+		"Content-Encoding",
+	)
 
 	hs := EchoServer.New()
 
 	//use jsoniter
 	hs.UseJsoniter()
+	//serve assets/x.br, x.zst or x.gz instead of assets/x to clients accepting them
+	if err := hs.SetPrecompressedEncodings("br", "zstd", "gzip"); err != nil {
+		logger.Errorln(err)
+	}
 	//log request info in Debug level
 	hs.Use(EchoMiddleware.LoggerWithConfig(EchoMiddleware.LoggerConfig{
 		Logger:            logger,
@@ -92,9 +62,6 @@ func main() {
 	})
 
 	hs.GET("/test1", func(c echo.Context) error {
-		sign := c.Request().Header.Get("Signature")
-		log.Println(sign)
-
 		var content struct {
 			Response  string    `json:"response"`
 			Timestamp time.Time `json:"timestamp"`
@@ -127,42 +94,42 @@ func main() {
 	//example request a file in server
 	hs.GET("/sendfiletest/:filename", func(c echo.Context) error {
 		name := c.Param("filename")
-		header, err := readHeader("assets/" + name + ".header")
+		header, err := EchoServer.ReadHeaderFile("assets/" + name + ".header")
 		if err != nil {
 			log.Println("readHeader error", err)
 		}
-		err = EchoServer.FileWithPause(hs, c, "assets/"+name, header, IgnoreHeader)
+		result, err := EchoServer.FileWithPause(hs, c, "assets/"+name, header, IgnoreHeader)
 		if err != nil {
-			log.Println("file not found")
+			log.Println("send file error", err)
 		}
+		log.Println("sent", result.Written, "bytes with status", result.StatusCode, "in", result.Duration)
 		return err
 	})
 
 	//example a cdn file request http://127.0.0.1:8080/api/cdn/somefile/path/filename.jpg?randkey=123456
-	hs.GET("/api/cdn/*", func(c echo.Context) error {
-		//get bindname
-		rPath := c.Param("*")
-		log.Println(rPath)
-		s := strings.SplitN(rPath, "/", 2)
-		for i, v := range s {
-			log.Println(i, v)
+	//serves cdn/somefile/path/filename.jpg, fetching it from the origin if missing.
+	//cdn urls must be signed by the control plane, e.g. with
+	//EchoServer.NewHMACSigner("k1", secret) and its Sign(url, EchoServer.SignOptions{Expires: ...}),
+	//so the cdn routes only exist when the secret is set
+	if secret := os.Getenv("CDN_SIGNING_SECRET"); secret != "" {
+		urlVerifier := EchoServer.NewURLVerifier(30 * time.Second)
+		if err := urlVerifier.AddHMACKey("k1", []byte(secret)); err != nil {
+			logger.Fatalln("CDN_SIGNING_SECRET:", err)
 		}
-		if len(s) < 1 {
-			return c.String(200, "url Error:"+c.Request().RequestURI)
-		}
-		bindName := s[0]
-		log.Println("bindname", bindName)
-		if bindName == "" {
-			return c.String(200, "url Error:"+c.Request().RequestURI)
-		}
-		fileName := "index.html"
-		if len(s) > 1 && s[1] != "" {
-			fileName = s[1]
+		tenants := EchoServer.NewTenantRouter(hs)
+		err := tenants.SetTenant("somefile", &EchoServer.Tenant{
+			Root:     "cdn/somefile",
+			Origin:   &EchoServer.OriginConfig{BaseURL: "http://127.0.0.1:9090/somefile", Timeout: 10 * time.Minute},
+			Policy:   IgnoreHeader,
+			Verifier: urlVerifier,
+		})
+		if err != nil {
+			logger.Errorln(err)
 		}
-		log.Println("fileName", fileName)
-
-		return c.String(200, c.Request().RequestURI)
-	})
+		tenants.Mount("/api/cdn")
+	} else {
+		logger.Infoln("CDN_SIGNING_SECRET is not set, /api/cdn is not served")
+	}
 
 	//example request http://127.0.0.1:8080/somefile/path/filename.jpg?randkey=123456
 	hs.GET("*", func(c echo.Context) error {
@@ -191,16 +158,6 @@ func main() {
 		return c.String(200, uri)
 	})
 
-	hs.GET("/test/:bindname/*", func(c echo.Context) error {
-		bindName := c.Param("bindname")
-		log.Println(bindName)
-		uri := c.Request().RequestURI
-		filePath := strings.Trim(uri, "/test/"+c.Param("bindname"))
-		log.Println(filePath)
-
-		return c.String(200, uri)
-	})
-
 	//post test
 	hs.POST("/testpost", func(c echo.Context) error {
 		var ts testStruct
@@ -0,0 +1,243 @@
+package MesonTerminalEchoServer
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultFDIdle is how long an unused descriptor stays open.
+const defaultFDIdle = time.Minute
+
+// An FDCache keeps the descriptors of recently served files open, so
+// repeated and concurrent serves of a large file share one descriptor
+// instead of opening, statting and closing it each time. Readers use ReadAt,
+// so they don't share a file offset.
+//
+// Entries are keyed by path and inode. A file replaced by a rename gets a
+// new entry while readers of the old one finish undisturbed; a descriptor
+// is closed once it is evicted and its last reader is done. On Linux the
+// files are sent with sendfile at each reader's offset when the response is
+// plain HTTP/1 on a connection of the HttpServer's own servers; net/http
+// can't reuse such a connection, so it is closed after the response.
+type FDCache struct {
+	max  int
+	idle time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*fdEntry
+	lru     *list.List
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type fdEntry struct {
+	path     string
+	f        *os.File
+	fi       os.FileInfo
+	refs     int
+	lastUsed time.Time
+	// elem is nil once the entry is evicted.
+	elem *list.Element
+}
+
+// NewFDCache returns a cache of at most max descriptors, at least 1, closing
+// the ones unused for idle; 0 means one minute. The unused descriptors are
+// closed in the background until Close is called.
+func NewFDCache(max int, idle time.Duration) *FDCache {
+	if max < 1 {
+		max = 1
+	}
+	if idle <= 0 {
+		idle = defaultFDIdle
+	}
+	fc := &FDCache{max: max, idle: idle, entries: map[string]*fdEntry{}, lru: list.New(), stop: make(chan struct{})}
+	go fc.sweeper()
+	return fc
+}
+
+// sweeper closes the idle descriptors until fc is closed, so they don't
+// keep removed files on disk while there is no traffic.
+func (fc *FDCache) sweeper() {
+	ticker := time.NewTicker(fc.idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fc.stop:
+			return
+		case now := <-ticker.C:
+			fc.mu.Lock()
+			fc.sweep(now)
+			fc.mu.Unlock()
+		}
+	}
+}
+
+// open returns a reader of the file at filePath, which Stat described as fi.
+func (fc *FDCache) open(filePath string, fi os.FileInfo) (File, error) {
+	now := time.Now()
+	fc.mu.Lock()
+	fc.sweep(now)
+	if e, ok := fc.entries[filePath]; ok {
+		if sameFile(e.fi, fi) {
+			e.refs++
+			e.lastUsed = now
+			fc.lru.MoveToFront(e.elem)
+			fc.mu.Unlock()
+			return newFDFile(fc, e), nil
+		}
+		// replaced or changed underneath
+		fc.evict(e)
+	}
+	fc.mu.Unlock()
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	ofi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	e := &fdEntry{path: filePath, f: f, fi: ofi, refs: 1, lastUsed: now}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if old, ok := fc.entries[filePath]; ok {
+		if sameFile(old.fi, ofi) {
+			// opened concurrently; share the cached one
+			old.refs++
+			f.Close()
+			return newFDFile(fc, old), nil
+		}
+		fc.evict(old)
+	}
+	e.elem = fc.lru.PushFront(e)
+	fc.entries[filePath] = e
+	for fc.lru.Len() > fc.max {
+		fc.evict(fc.lru.Back().Value.(*fdEntry))
+	}
+	return newFDFile(fc, e), nil
+}
+
+// evict removes e from the cache and closes it unless it is in use.
+// fc.mu must be held.
+func (fc *FDCache) evict(e *fdEntry) {
+	if e.elem == nil {
+		return
+	}
+	fc.lru.Remove(e.elem)
+	e.elem = nil
+	if fc.entries[e.path] == e {
+		delete(fc.entries, e.path)
+	}
+	if e.refs == 0 {
+		e.f.Close()
+	}
+}
+
+// sweep evicts the entries unused for longer than fc.idle. fc.mu must be
+// held.
+func (fc *FDCache) sweep(now time.Time) {
+	for el := fc.lru.Back(); el != nil; {
+		e := el.Value.(*fdEntry)
+		prev := el.Prev()
+		if now.Sub(e.lastUsed) < fc.idle {
+			break
+		}
+		if e.refs == 0 {
+			fc.evict(e)
+		}
+		el = prev
+	}
+}
+
+func (fc *FDCache) release(e *fdEntry) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	e.refs--
+	e.lastUsed = time.Now()
+	if e.refs == 0 && e.elem == nil {
+		e.f.Close()
+	}
+}
+
+// Invalidate closes the cached descriptor of the file at filePath once it
+// is no longer in use, for example after the file was removed.
+func (fc *FDCache) Invalidate(filePath string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if e, ok := fc.entries[filePath]; ok {
+		fc.evict(e)
+	}
+}
+
+// Close closes every descriptor once it is no longer in use, and stops
+// closing idle descriptors in the background.
+func (fc *FDCache) Close() {
+	fc.stopOnce.Do(func() { close(fc.stop) })
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, e := range fc.entries {
+		fc.evict(e)
+	}
+}
+
+// Len returns the number of cached descriptors.
+func (fc *FDCache) Len() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.lru.Len()
+}
+
+// SetFDCache makes FileWithPause and ServeFile open the files of the native
+// file system through fc. A nil fc turns this off.
+func (hs *HttpServer) SetFDCache(fc *FDCache) {
+	hs.etagMu.Lock()
+	defer hs.etagMu.Unlock()
+	hs.fdCache = fc
+}
+
+func (hs *HttpServer) GetFDCache() *FDCache {
+	hs.etagMu.RLock()
+	defer hs.etagMu.RUnlock()
+	return hs.fdCache
+}
+
+// An fdFile reads a file through a descriptor shared with other readers.
+type fdFile struct {
+	*io.SectionReader
+	fc     *FDCache
+	e      *fdEntry
+	closed bool
+}
+
+func newFDFile(fc *FDCache, e *fdEntry) *fdFile {
+	return &fdFile{SectionReader: io.NewSectionReader(e.f, 0, e.fi.Size()), fc: fc, e: e}
+}
+
+func (f *fdFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.fc.release(f.e)
+	return nil
+}
+
+func (f *fdFile) Stat() (fs.FileInfo, error) { return f.e.fi, nil }
+
+func (f *fdFile) sharedFile() (*os.File, int64) {
+	off, _ := f.Seek(0, io.SeekCurrent)
+	return f.e.f, off
+}
+
+func (f *fdFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.e.fi.Name(), Err: errors.New("not a directory")}
+}
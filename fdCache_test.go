@@ -0,0 +1,165 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestFDCacheSendfileAtOffset(t *testing.T) {
+	if !sendfileSupported {
+		t.Skip("no sendfile")
+	}
+	root := t.TempDir()
+	body := make([]byte, 3*sendfileChunk+12345)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+	filePath := filepath.Join(root, "big.bin")
+	if err := os.WriteFile(filePath, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFDCache(4, 0)
+	defer fc.Close()
+	hs := New()
+	hs.SetFDCache(fc)
+	hs.GET("/big.bin", func(c echo.Context) error {
+		_, err := FileWithPause(hs, c, filePath, nil, nil)
+		return err
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Server.Serve(ln)
+	defer hs.CloseServer()
+	u := "http://" + ln.Addr().String() + "/big.bin"
+
+	ranges := [][2]int{{0, len(body) - 1}, {100, 200}, {sendfileChunk - 3, 2*sendfileChunk + 9}, {len(body) - 10, len(body) - 1}}
+	var wg sync.WaitGroup
+	for _, ra := range ranges {
+		wg.Add(1)
+		go func(ra [2]int) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, u, nil)
+			if ra[0] != 0 || ra[1] != len(body)-1 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", ra[0], ra[1]))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil || !bytes.Equal(got, body[ra[0]:ra[1]+1]) {
+				t.Errorf("range %v: %d bytes, %v", ra, len(got), err)
+			}
+			if !resp.Close {
+				t.Errorf("range %v: connection kept open after sendfile", ra)
+			}
+		}(ra)
+	}
+	wg.Wait()
+
+	fc.mu.Lock()
+	e := fc.entries[filePath]
+	fc.mu.Unlock()
+	if e == nil {
+		t.Fatal("descriptor not cached")
+	}
+	if off, err := e.f.Seek(0, io.SeekCurrent); off != 0 || err != nil {
+		t.Errorf("shared offset moved to %d, %v", off, err)
+	}
+}
+
+func openFDCache(t *testing.T, fc *FDCache, filePath string) {
+	t.Helper()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fc.open(filePath, fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestFDCacheNonPositiveMax(t *testing.T) {
+	root := t.TempDir()
+	fc := NewFDCache(-1, 0)
+	defer fc.Close()
+	for _, name := range []string{"a", "b"} {
+		p := filepath.Join(root, name)
+		os.WriteFile(p, []byte(name), 0644)
+		openFDCache(t, fc, p)
+	}
+	if n := fc.Len(); n != 1 {
+		t.Errorf("%d descriptors cached, want 1", n)
+	}
+}
+
+func TestFDCacheClosesIdleWithoutTraffic(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(filePath, []byte("data"), 0644)
+	fc := NewFDCache(4, 20*time.Millisecond)
+	defer fc.Close()
+	openFDCache(t, fc, filePath)
+	deadline := time.Now().Add(2 * time.Second)
+	for fc.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle descriptor still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCachesInvalidatedOnEvictAndQuarantine(t *testing.T) {
+	root := t.TempDir()
+	hs := New()
+	fc := NewFDCache(4, 0)
+	defer fc.Close()
+	mc := NewMemoryCache(1<<20, 0)
+	hs.SetFDCache(fc)
+	hs.SetMemoryCache(mc)
+	ci, err := NewCacheIndex(filepath.Join(root, "index.json"), EvictLRU, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetCacheIndex(ci)
+	store, err := NewHashStore(filepath.Join(root, "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetHashStore(store)
+
+	evicted := filepath.Join(root, "evicted")
+	quarantined := filepath.Join(root, "quarantined")
+	for _, p := range []string{evicted, quarantined} {
+		os.WriteFile(p, []byte("content"), 0644)
+		openFDCache(t, fc, p)
+		fi, _ := os.Stat(p)
+		mc.put(&memObject{key: "body:" + p, fi: fi, cost: fi.Size(), data: []byte("content")})
+	}
+
+	ci.Evict(evicted)
+	fi, _ := os.Stat(quarantined)
+	store.Record(quarantined)
+	store.Verify(quarantined, fi, sha256Hash("other"))
+	if n := fc.Len(); n != 0 {
+		t.Errorf("%d descriptors still cached", n)
+	}
+	if _, _, used := mc.Stats(); used != 0 {
+		t.Errorf("%d bytes still in memory", used)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package MesonTerminalEchoServer
+
+import "os"
+
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
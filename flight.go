@@ -0,0 +1,96 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup runs one call per key at a time; concurrent callers with the
+// same key wait for the running call and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+
+	// waiters and cancel are only used by doContext.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn for key unless a call for key is already running, in which case
+// it waits for that call. shared reports whether the result came from
+// another caller's call.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err, true
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
+
+// doContext is like do, but fn runs in its own goroutine on a context derived
+// from parent rather than from any caller's ctx. A caller whose ctx is done
+// stops waiting and gets ctx.Err() without failing the others; once every
+// caller stopped waiting, fn's context is cancelled.
+func (g *flightGroup) doContext(ctx, parent context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(parent)
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.val, c.err = fn(fctx)
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody wants the result any more; a new caller starts over
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
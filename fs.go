@@ -1,9 +1,11 @@
 package MesonTerminalEchoServer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"mime/multipart"
 	"net/http"
@@ -15,6 +17,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -36,25 +39,25 @@ import (
 // An empty Dir is treated as ".".
 type Dir string
 
-// mapDirOpenError maps the provided non-nil error from opening name
+// mapOpenError maps the provided non-nil error from opening name
 // to a possibly better non-nil error. In particular, it turns OS-specific errors
-// about opening files in non-directories into os.ErrNotExist. See Issue 18984.
-func mapDirOpenError(originalErr error, name string) error {
-	if os.IsNotExist(originalErr) || os.IsPermission(originalErr) {
+// about opening files in non-directories into fs.ErrNotExist. See Issue 18984.
+func mapOpenError(originalErr error, name string, sep rune, stat func(string) (fs.FileInfo, error)) error {
+	if errors.Is(originalErr, fs.ErrNotExist) || errors.Is(originalErr, fs.ErrPermission) {
 		return originalErr
 	}
 
-	parts := strings.Split(name, string(filepath.Separator))
+	parts := strings.Split(name, string(sep))
 	for i := range parts {
 		if parts[i] == "" {
 			continue
 		}
-		fi, err := os.Stat(strings.Join(parts[:i+1], string(filepath.Separator)))
+		fi, err := stat(strings.Join(parts[:i+1], string(sep)))
 		if err != nil {
 			return originalErr
 		}
 		if !fi.IsDir() {
-			return os.ErrNotExist
+			return fs.ErrNotExist
 		}
 	}
 	return originalErr
@@ -73,11 +76,24 @@ func (d Dir) Open(name string) (File, error) {
 	fullName := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
 	f, err := os.Open(fullName)
 	if err != nil {
-		return nil, mapDirOpenError(err, fullName)
+		return nil, mapOpenError(err, fullName, filepath.Separator, os.Stat)
 	}
 	return f, nil
 }
 
+// dirPath returns the native path of name in fsys if fsys is a Dir, and ""
+// otherwise.
+func dirPath(fsys FileSystem, name string) string {
+	dir, ok := fsys.(Dir)
+	if !ok {
+		return ""
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+name)))
+}
+
 // A FileSystem implements access to a collection of named files.
 // The elements in a file path are separated by slash ('/', U+002F)
 // characters, regardless of host operating system convention.
@@ -85,6 +101,14 @@ type FileSystem interface {
 	Open(name string) (File, error)
 }
 
+// A contextFileSystem is a FileSystem whose files can stop waiting for their
+// content once a context is done, like PartialStore. FileWithPauseFS and
+// ServeFile open its files with the context of the transfer.
+type contextFileSystem interface {
+	FileSystem
+	OpenContext(ctx context.Context, name string) (File, error)
+}
+
 // A File is returned by a FileSystem's Open method and can be
 // served by the FileServer implementation.
 //
@@ -107,12 +131,13 @@ var htmlReplacer = strings.NewReplacer(
 	"'", "&#39;",
 )
 
-func dirList(w http.ResponseWriter, r *http.Request, f File) {
+// dirList returns the status code it wrote.
+func dirList(w http.ResponseWriter, r *http.Request, f File) int {
 	dirs, err := f.Readdir(-1)
 	if err != nil {
 		//logf(r, "http: error reading directory: %v", err)
 		http.Error(w, "Error reading directory", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError
 	}
 	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
 
@@ -130,6 +155,7 @@ func dirList(w http.ResponseWriter, r *http.Request, f File) {
 		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", url.String(), htmlReplacer.Replace(name))
 	}
 	fmt.Fprintf(w, "</pre>\n")
+	return http.StatusOK
 }
 
 // errSeeker is returned by ServeContent's sizeFunc when the content
@@ -146,10 +172,24 @@ var errNoOverlap = errors.New("invalid range: failed to overlap")
 // if modtime.IsZero(), modtime is unknown.
 // content must be seeked to the beginning of the file.
 // The sizeFunc is called at most once. Its error, if any, is sent in the HTTP response.
-func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name string, modtime time.Time, sizeFunc func() (int64, error), content io.ReadSeeker) {
+// opts may be nil.
+func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name string, modtime time.Time, sizeFunc func() (int64, error), content io.ReadSeeker, opts *serveOptions) (res TransferResult) {
+	start := time.Now()
+	res.Size = -1
+	defer func() { res.Duration = time.Since(start) }()
+
 	setLastModified(w, modtime)
-	done, rangeReq := checkPreconditions(w, r, modtime)
+	done, doneCode, rangeReq := checkPreconditions(w, r, modtime)
 	if done {
+		if opts != nil {
+			hs.rewriteHeader(w.Header(), r, name, mime.TypeByExtension(filepath.Ext(name)), doneCode, opts)
+		}
+		if doneCode == http.StatusNotModified {
+			writeNotModified(w)
+		} else {
+			w.WriteHeader(doneCode)
+		}
+		res.StatusCode = doneCode
 		return
 	}
 
@@ -169,6 +209,7 @@ func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name s
 			_, err := content.Seek(0, io.SeekStart) // rewind to output whole file
 			if err != nil {
 				http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+				res.StatusCode = http.StatusInternalServerError
 				return
 			}
 		}
@@ -180,19 +221,29 @@ func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name s
 	size, err := sizeFunc()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		res.StatusCode = http.StatusInternalServerError
 		return
 	}
+	res.Size = size
 
 	// handle Content-Range header.
 	sendSize := size
 	var sendContent io.Reader = content
-	if size >= 0 {
+	if opts != nil && opts.compress != "" {
+		// the length of the body is only known once it is compressed, so
+		// neither it nor ranges of it can be announced
+		sendSize = -1
+		pr := encodeReader(opts.compress, content)
+		defer pr.Close()
+		sendContent = pr
+	} else if size >= 0 {
 		ranges, err := parseRange(rangeReq, size)
 		if err != nil {
 			if err == errNoOverlap {
 				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
 			}
 			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			res.StatusCode = http.StatusRequestedRangeNotSatisfiable
 			return
 		}
 		if sumRangesSize(ranges) > size {
@@ -218,6 +269,7 @@ func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name s
 			ra := ranges[0]
 			if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
 				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				res.StatusCode = http.StatusRequestedRangeNotSatisfiable
 				return
 			}
 			sendSize = ra.length
@@ -253,17 +305,60 @@ func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name s
 			}()
 		}
 
+		for _, ra := range ranges {
+			res.Ranges = append(res.Ranges, ByteRange{Start: ra.start, Length: ra.length})
+		}
+
 		w.Header().Set("Accept-Ranges", "bytes")
-		if w.Header().Get("Content-Encoding") == "" {
+		// a stored variant has a known length, unlike a body encoded by a
+		// wrapping writer
+		if w.Header().Get("Content-Encoding") == "" || opts != nil && opts.encoding != "" {
 			w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
 		}
 	}
 
+	if opts != nil {
+		if opts.digest != nil && w.Header().Get("Content-Encoding") == "" {
+			opts.digest.setHeader(w.Header())
+		}
+		hs.rewriteHeader(w.Header(), r, name, ctype, code, opts)
+	}
+	conn := sendfileConn(w, r, sendContent)
 	w.WriteHeader(code)
+	res.StatusCode = code
+
+	info := &TransferInfo{
+		Request:    r,
+		ClientIP:   hs.clientIP(r),
+		Name:       name,
+		StatusCode: code,
+		Size:       size,
+		Ranges:     res.Ranges,
+		SendSize:   sendSize,
+	}
+	progress, end := hs.hooks.transferStart(info)
+	defer func() {
+		res.Duration = time.Since(start)
+		end(res)
+	}()
 
 	if r.Method != "HEAD" {
-		CopyN(hs, w, sendContent, sendSize)
+		limits, release := hs.transferLimits(r, opts)
+		defer release()
+		ctx, cancel := hs.transferContext(r.Context())
+		defer cancel()
+		cp := copier{hs: hs, ctx: ctx, limits: limits, progress: progress, conn: conn}
+		if sendSize < 0 {
+			res.Written, res.Err = cp.copyBuffer(w, sendContent, nil)
+		} else {
+			res.Written, res.Err = cp.copyN(w, sendContent, sendSize)
+		}
+		res.Paused = cp.paused
+		if res.Err == context.Canceled && r.Context().Err() != nil {
+			res.Err = ErrClientGone
+		}
 	}
+	return
 }
 
 // CopyN copies n bytes (or until an error) from src to dst.
@@ -271,10 +366,60 @@ func serveContent(hs *HttpServer, w http.ResponseWriter, r *http.Request, name s
 // error encountered while copying.
 // On return, written == n if and only if err == nil.
 //
-// If dst implements the ReaderFrom interface,
-// the copy is implemented using it.
+// The copy honors the server pause and the global bandwidth limit.
 func CopyN(hs *HttpServer, dst io.Writer, src io.Reader, n int64) (written int64, err error) {
-	written, err = Copy(hs, dst, io.LimitReader(src, n))
+	return CopyNContext(context.Background(), hs, dst, src, n)
+}
+
+func Copy(hs *HttpServer, dst io.Writer, src io.Reader) (written int64, err error) {
+	return CopyContext(context.Background(), hs, dst, src)
+}
+
+// CopyNContext is like CopyN but stops as soon as ctx is done or the server
+// is closed, even while the transfer is paused or waiting for bandwidth.
+// The returned error is then ctx.Err() or ErrServerClosing.
+func CopyNContext(ctx context.Context, hs *HttpServer, dst io.Writer, src io.Reader, n int64) (written int64, err error) {
+	ctx, cancel := hs.transferContext(ctx)
+	defer cancel()
+	cp := copier{hs: hs, ctx: ctx, limits: limiterChain{hs.bandwidth}}
+	return cp.copyN(dst, src, n)
+}
+
+// CopyContext is like Copy but stops as soon as ctx is done or the server
+// is closed. See CopyNContext.
+func CopyContext(ctx context.Context, hs *HttpServer, dst io.Writer, src io.Reader) (written int64, err error) {
+	ctx, cancel := hs.transferContext(ctx)
+	defer cancel()
+	cp := copier{hs: hs, ctx: ctx, limits: limiterChain{hs.bandwidth}}
+	return cp.copyBuffer(dst, src, nil)
+}
+
+// A copier copies the body of one transfer, honoring the server pause and
+// every bandwidth limit that applies to that transfer. It stops when ctx
+// is done.
+type copier struct {
+	hs     *HttpServer
+	ctx    context.Context
+	limits limiterChain
+	// paused is the time spent waiting for the server pause to end.
+	paused time.Duration
+	// progress, if set, is called with the total written after each write.
+	progress func(written int64)
+	// conn, if set, is the client connection sharedFile sources are sent
+	// to with sendfile at their own offset.
+	conn syscall.RawConn
+}
+
+func (cp *copier) copyN(dst io.Writer, src io.Reader, n int64) (written int64, err error) {
+	if f, ok := src.(sharedFile); ok && cp.conn != nil {
+		return cp.sendFileAt(cp.conn, dst, f, n)
+	}
+	if f, ok := src.(*os.File); ok {
+		if rf, count, ok := sendfileWriter(dst); ok {
+			return cp.sendFile(rf, count, f, n)
+		}
+	}
+	written, err = cp.copyBuffer(dst, io.LimitReader(src, n), nil)
 	if written == n {
 		return n, nil
 	}
@@ -285,22 +430,12 @@ func CopyN(hs *HttpServer, dst io.Writer, src io.Reader, n int64) (written int64
 	return
 }
 
-func Copy(hs *HttpServer, dst io.Writer, src io.Reader) (written int64, err error) {
-	return copyBuffer(hs, dst, src, nil)
-}
-
-// copyBuffer is the actual implementation of Copy and CopyBuffer.
+// copyBuffer is the actual implementation of Copy and CopyN.
 // if buf is nil, one is allocated.
-func copyBuffer(hs *HttpServer, dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
-	// If the reader has a WriteTo method, use it to do the copy.
-	// Avoids an allocation and a copy.
-	if wt, ok := src.(io.WriterTo); ok {
-		return wt.WriteTo(dst)
-	}
-	// Similarly, if the writer has a ReadFrom method, use it to do the copy.
-	if rt, ok := dst.(io.ReaderFrom); ok {
-		return rt.ReadFrom(src)
-	}
+//
+// Unlike io.Copy it never hands the copy over to a WriterTo or ReaderFrom,
+// since those would bypass the pause and bandwidth checks between reads.
+func (cp *copier) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
 	if buf == nil {
 		size := 32 * 1024
 		if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
@@ -313,15 +448,35 @@ func copyBuffer(hs *HttpServer, dst io.Writer, src io.Reader, buf []byte) (writt
 		buf = make([]byte, size)
 	}
 	for {
-		for time.Now().Unix() < hs.GetPauseMoment() {
-			time.Sleep(time.Millisecond * 300)
+		paused, er := cp.hs.pause.wait(cp.ctx)
+		cp.paused += paused
+		if er != nil {
+			err = cp.abortErr(er)
+			break
+		}
+		n := len(buf)
+		if l, ok := src.(*io.LimitedReader); ok && l.N < int64(n) {
+			// don't wait for tokens that can't be used
+			n = 0
+			if l.N > 0 {
+				n = int(l.N)
+			}
+		}
+		n, er = cp.limits.take(cp.ctx, n)
+		if er != nil {
+			err = cp.abortErr(er)
+			break
 		}
 
-		nr, er := src.Read(buf)
+		nr, er := src.Read(buf[:n])
+		cp.limits.refund(n - nr)
 		if nr > 0 {
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
+				if cp.progress != nil {
+					cp.progress(written)
+				}
 			}
 			if ew != nil {
 				err = ew
@@ -342,6 +497,14 @@ func copyBuffer(hs *HttpServer, dst io.Writer, src io.Reader, buf []byte) (writt
 	return written, err
 }
 
+// abortErr reports why the transfer stopped given the error of its context.
+func (cp *copier) abortErr(err error) error {
+	if cp.hs.isClosing() {
+		return ErrServerClosing
+	}
+	return err
+}
+
 // scanETag determines if a syntactically valid ETag is present at s. If so,
 // the ETag and remaining text after consuming ETag is returned. Otherwise,
 // it returns "", "".
@@ -552,30 +715,27 @@ func writeNotModified(w http.ResponseWriter) {
 }
 
 // checkPreconditions evaluates http.Request preconditions and reports whether a precondition
-// resulted in sending StatusNotModified or StatusPreconditionFailed.
-func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) (done bool, rangeHeader string) {
+// requires answering StatusNotModified or StatusPreconditionFailed instead of the content,
+// and which of the two. The caller writes that response.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) (done bool, code int, rangeHeader string) {
 	// This function carefully follows RFC 7232 section 6.
 	ch := checkIfMatch(w, r)
 	if ch == condNone {
 		ch = checkIfUnmodifiedSince(r, modtime)
 	}
 	if ch == condFalse {
-		w.WriteHeader(http.StatusPreconditionFailed)
-		return true, ""
+		return true, http.StatusPreconditionFailed, ""
 	}
 	switch checkIfNoneMatch(w, r) {
 	case condFalse:
 		if r.Method == "GET" || r.Method == "HEAD" {
-			writeNotModified(w)
-			return true, ""
+			return true, http.StatusNotModified, ""
 		} else {
-			w.WriteHeader(http.StatusPreconditionFailed)
-			return true, ""
+			return true, http.StatusPreconditionFailed, ""
 		}
 	case condNone:
 		if checkIfModifiedSince(r, modtime) == condFalse {
-			writeNotModified(w)
-			return true, ""
+			return true, http.StatusNotModified, ""
 		}
 	}
 
@@ -583,11 +743,11 @@ func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Tim
 	if rangeHeader != "" && checkIfRange(w, r, modtime) == condFalse {
 		rangeHeader = ""
 	}
-	return false, rangeHeader
+	return false, 0, rangeHeader
 }
 
 // name is '/'-separated, not filepath.Separator.
-func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSystem, name string, redirect bool) {
+func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSystem, name string, redirect bool) TransferResult {
 	const indexPage = "/index.html"
 
 	// redirect .../index.html to .../
@@ -595,14 +755,16 @@ func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSy
 	// which would be a problem running under StripPrefix
 	if strings.HasSuffix(r.URL.Path, indexPage) {
 		localRedirect(w, r, "./")
-		return
+		return TransferResult{StatusCode: http.StatusMovedPermanently, Size: -1}
 	}
 
-	f, err := fs.Open(name)
+	ctx, cancel := hs.transferContext(r.Context())
+	defer cancel()
+	f, err := hs.openFile(ctx, fs, name)
 	if err != nil {
 		msg, code := toHTTPError(err)
 		http.Error(w, msg, code)
-		return
+		return TransferResult{StatusCode: code, Size: -1}
 	}
 	defer f.Close()
 
@@ -610,7 +772,7 @@ func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSy
 	if err != nil {
 		msg, code := toHTTPError(err)
 		http.Error(w, msg, code)
-		return
+		return TransferResult{StatusCode: code, Size: -1}
 	}
 
 	if redirect {
@@ -620,12 +782,12 @@ func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSy
 		if d.IsDir() {
 			if url[len(url)-1] != '/' {
 				localRedirect(w, r, path.Base(url)+"/")
-				return
+				return TransferResult{StatusCode: http.StatusMovedPermanently, Size: -1}
 			}
 		} else {
 			if url[len(url)-1] == '/' {
 				localRedirect(w, r, "../"+path.Base(url))
-				return
+				return TransferResult{StatusCode: http.StatusMovedPermanently, Size: -1}
 			}
 		}
 	}
@@ -635,7 +797,7 @@ func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSy
 		// redirect if the directory name doesn't end in a slash
 		if url == "" || url[len(url)-1] != '/' {
 			localRedirect(w, r, path.Base(url)+"/")
-			return
+			return TransferResult{StatusCode: http.StatusMovedPermanently, Size: -1}
 		}
 
 		// use contents of index.html for directory, if present
@@ -656,16 +818,23 @@ func serveFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, fs FileSy
 	if d.IsDir() {
 		if checkIfModifiedSince(r, d.ModTime()) == condFalse {
 			writeNotModified(w)
-			return
+			return TransferResult{StatusCode: http.StatusNotModified, Size: -1}
 		}
 		setLastModified(w, d.ModTime())
-		dirList(w, r, f)
-		return
+		return TransferResult{StatusCode: dirList(w, r, f), Size: -1}
 	}
 
+	hs.setETag(w.Header(), dirPath(fs, name), d, nil)
+
+	opts := &serveOptions{}
+	content, size, release := hs.selectEncoding(w.Header(), r, fs, name, d, f, opts)
+	defer release()
+
 	// serveContent will check modification time
-	sizeFunc := func() (int64, error) { return d.Size(), nil }
-	serveContent(hs, w, r, d.Name(), d.ModTime(), sizeFunc, f)
+	sizeFunc := func() (int64, error) { return size, nil }
+	res := serveContent(hs, w, r, d.Name(), d.ModTime(), sizeFunc, content, opts)
+	hs.persistCompressed(r, d, opts, res.StatusCode)
+	return res
 }
 
 // toHTTPError returns a non-specific HTTP error message and status code
@@ -717,14 +886,27 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 //
 // If the caller has set w's ETag header formatted per RFC 7232, section 2.3,
 // ServeContent uses it to handle requests using If-Match, If-None-Match, or If-Range.
+// Otherwise, if content has a Stat method like *os.File, ServeContent sets a
+// strong ETag derived from the file unless SetAutoETag turned that off.
 //
 // Note that *os.File implements the io.ReadSeeker interface.
-func ServeContent(hs *HttpServer, w http.ResponseWriter, req *http.Request, name string, modtime time.Time, content io.ReadSeeker) {
+//
+// ServeContent returns what was sent to the client.
+func ServeContent(hs *HttpServer, w http.ResponseWriter, req *http.Request, name string, modtime time.Time, content io.ReadSeeker) TransferResult {
+	if f, ok := content.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			filePath := ""
+			if osf, ok := content.(*os.File); ok {
+				filePath = osf.Name()
+			}
+			hs.setETag(w.Header(), filePath, fi, nil)
+		}
+	}
+
 	sizeFunc := func() (int64, error) {
 		size, err := content.Seek(0, io.SeekEnd)
 		if err != nil {
 			return 0, errSeeker
-			return 0, nil
 		}
 		_, err = content.Seek(0, io.SeekStart)
 		if err != nil {
@@ -734,7 +916,7 @@ func ServeContent(hs *HttpServer, w http.ResponseWriter, req *http.Request, name
 		return size, nil
 	}
 
-	serveContent(hs, w, req, name, modtime, sizeFunc, content)
+	return serveContent(hs, w, req, name, modtime, sizeFunc, content, nil)
 }
 
 // errSeeker is returned by ServeContent's sizeFunc when the content
@@ -764,7 +946,9 @@ var errSeeker = errors.New("seeker can't seek")
 // Outside of those two special cases, ServeFile does not use
 // r.URL.Path for selecting the file or directory to serve; only the
 // file or directory provided in the name argument is used.
-func ServeFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, name string) {
+//
+// ServeFile returns what was sent to the client.
+func ServeFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, name string) TransferResult {
 	if containsDotDot(r.URL.Path) {
 		// Too many programs use r.URL.Path to construct the argument to
 		// serveFile. Reject the http.Request under the assumption that happened
@@ -772,10 +956,10 @@ func ServeFile(hs *HttpServer, w http.ResponseWriter, r *http.Request, name stri
 		// Note that name might not contain "..", for example if code (still
 		// incorrectly) used filepath.Join(myDir, r.URL.Path).
 		http.Error(w, "invalid URL path", http.StatusBadRequest)
-		return
+		return TransferResult{StatusCode: http.StatusBadRequest, Size: -1}
 	}
 	dir, file := filepath.Split(name)
-	serveFile(hs, w, r, Dir(dir), file, false)
+	return serveFile(hs, w, r, Dir(dir), file, false)
 }
 
 func containsDotDot(v string) bool {
@@ -7,6 +7,7 @@ require (
 	github.com/universe-30/EchoMiddleware v0.1.4
 	github.com/universe-30/LogrusULog v0.1.17
 	github.com/universe-30/ULog v0.1.15
+	golang.org/x/net v0.0.0-20210913180222-943fd674d43e
 )
 
 require (
@@ -21,7 +22,6 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
-	golang.org/x/net v0.0.0-20210913180222-943fd674d43e // indirect
 	golang.org/x/sys v0.0.0-20210910150752-751e447fb3d0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
@@ -0,0 +1,478 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DigestSuffix is appended to a file path to name its digest record.
+const DigestSuffix = ".digest"
+
+// ErrIntegrity is returned for files whose content doesn't match their
+// recorded or expected digest. Such files are quarantined.
+var ErrIntegrity = errors.New("file content doesn't match its digest")
+
+var (
+	digestMu         sync.RWMutex
+	digestAlgorithms = map[string]func() hash.Hash{
+		"sha-256": sha256.New,
+		"sha-512": sha512.New,
+	}
+)
+
+// RegisterDigestAlgorithm makes a digest algorithm available to hash
+// stores under name, which should be its name in the HTTP digest algorithm
+// registry, such as "blake3". sha-256 and sha-512 are always available.
+func RegisterDigestAlgorithm(name string, newHash func() hash.Hash) {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	digestAlgorithms[strings.ToLower(name)] = newHash
+}
+
+func digestAlgorithm(name string) (func() hash.Hash, bool) {
+	digestMu.RLock()
+	defer digestMu.RUnlock()
+	newHash, ok := digestAlgorithms[strings.ToLower(name)]
+	return newHash, ok
+}
+
+// normalizeDigestName maps the names used in content hashes, like "sha256",
+// to the registry names, like "sha-256".
+func normalizeDigestName(name string) string {
+	name = strings.ToLower(name)
+	switch name {
+	case "sha256":
+		return "sha-256"
+	case "sha512":
+		return "sha-512"
+	}
+	return name
+}
+
+// A DigestRecord holds the digests of a file as it was when they were
+// computed. It is stored as JSON next to the file.
+type DigestRecord struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Digests maps algorithm names to hex encoded digests.
+	Digests map[string]string `json:"digests"`
+}
+
+// matches reports whether r was computed for the file as described by fi.
+func (r *DigestRecord) matches(fi os.FileInfo) bool {
+	return r.Size == fi.Size() && r.ModTime.Equal(fi.ModTime())
+}
+
+// ContentHash returns the sha-256 digest of r as "sha256:hex".
+func (r *DigestRecord) ContentHash() string {
+	if d, ok := r.Digests["sha-256"]; ok {
+		return "sha256:" + d
+	}
+	return ""
+}
+
+// setHeader sets the Repr-Digest and the older Digest header for r.
+func (r *DigestRecord) setHeader(h http.Header) {
+	names := make([]string, 0, len(r.Digests))
+	for name := range r.Digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var repr, legacy []string
+	for _, name := range names {
+		sum, err := hex.DecodeString(r.Digests[name])
+		if err != nil {
+			continue
+		}
+		b64 := base64.StdEncoding.EncodeToString(sum)
+		repr = append(repr, name+"=:"+b64+":")
+		legacy = append(legacy, strings.ToUpper(name)+"="+b64)
+	}
+	if len(repr) > 0 {
+		h.Set("Repr-Digest", strings.Join(repr, ", "))
+		h.Set("Digest", strings.Join(legacy, ","))
+	}
+}
+
+// A HashStore computes the digests of cached files, persists them next to
+// the files and verifies the files against them. A file is hashed after the
+// first serve since it changed, and checked against its digests by Scrub. Files that fail verification
+// are moved to the quarantine directory together with their sidecars.
+type HashStore struct {
+	quarantineDir string
+	algorithms    []string
+
+	mu      sync.Mutex
+	records map[string]*DigestRecord
+	// pending holds the paths being hashed in the background.
+	pending map[string]bool
+	// invalidate, if set, drops a quarantined file from the server's caches.
+	invalidate func(path string)
+}
+
+// NewHashStore returns a store computing sha-256 and the extra algorithms,
+// which must have been registered, and quarantining to quarantineDir.
+func NewHashStore(quarantineDir string, extra ...string) (*HashStore, error) {
+	algorithms := []string{"sha-256"}
+	for _, name := range extra {
+		name = strings.ToLower(name)
+		if _, ok := digestAlgorithm(name); !ok {
+			return nil, fmt.Errorf("unknown digest algorithm %q", name)
+		}
+		if name != "sha-256" {
+			algorithms = append(algorithms, name)
+		}
+	}
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return nil, err
+	}
+	return &HashStore{
+		quarantineDir: quarantineDir,
+		algorithms:    algorithms,
+		records:       map[string]*DigestRecord{},
+		pending:       map[string]bool{},
+	}, nil
+}
+
+// Record computes and persists the digests of the file at path. Writers of
+// cache files call it after replacing a file on purpose.
+func (s *HashStore) Record(path string) (*DigestRecord, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := s.compute(path, fi)
+	if err != nil {
+		return nil, err
+	}
+	return rec, s.save(path, rec)
+}
+
+// Lookup returns the persisted record of path if it still describes the
+// file as given by fi.
+func (s *HashStore) Lookup(path string, fi os.FileInfo) (*DigestRecord, bool) {
+	rec, err := s.load(path)
+	if err != nil || !rec.matches(fi) {
+		return nil, false
+	}
+	return rec, true
+}
+
+// ContentHash implements HashSource.
+func (s *HashStore) ContentHash(path string, fi os.FileInfo) (string, bool) {
+	rec, ok := s.Lookup(path, fi)
+	if !ok {
+		return "", false
+	}
+	hash := rec.ContentHash()
+	return hash, hash != ""
+}
+
+// Verify returns the digests of the file at path as described by fi. A
+// file whose record still matches fi is checked against expected, a content
+// hash such as "sha256:hex", if given; on a mismatch it is quarantined and
+// ErrIntegrity returned. A file that changed since its digests were
+// recorded, or has none, is new content: it is hashed in the background and
+// nil is returned until its record is ready. If that hash doesn't match
+// expected the file is quarantined then.
+func (s *HashStore) Verify(path string, fi os.FileInfo, expected string) (*DigestRecord, error) {
+	rec, err := s.load(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if rec != nil && rec.matches(fi) {
+		if !rec.hasContentHash(expected) {
+			return nil, s.quarantine(path)
+		}
+		return rec, nil
+	}
+	s.mu.Lock()
+	pending := s.pending[path]
+	s.pending[path] = true
+	s.mu.Unlock()
+	if !pending {
+		go func() {
+			s.verify(path, fi, expected, false)
+			s.mu.Lock()
+			delete(s.pending, path)
+			s.mu.Unlock()
+		}()
+	}
+	return nil, nil
+}
+
+// hasContentHash reports whether r agrees with the content hash hash. An
+// empty hash or one of an algorithm r has no digest for agrees.
+func (r *DigestRecord) hasContentHash(hash string) bool {
+	name, want, ok := parseContentHash(hash)
+	if !ok {
+		return true
+	}
+	got, have := r.Digests[name]
+	return !have || got == want
+}
+
+// verify hashes the file as described by fi and records it, or quarantines
+// it if it doesn't match expected. With force the file is checked against
+// its previous record even if the record still matches fi, as a file that
+// changed while keeping its size and modification time has rotted;
+// otherwise a record that doesn't match fi belongs to previous content and
+// is replaced.
+func (s *HashStore) verify(path string, fi os.FileInfo, expected string, force bool) (*DigestRecord, error) {
+	old, err := s.load(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if old != nil && old.matches(fi) && !force {
+		return old, nil
+	}
+	rec, err := s.compute(path, fi)
+	if err != nil {
+		return nil, err
+	}
+	if now, err := os.Stat(path); err != nil || !rec.matches(now) {
+		// changed while it was hashed; the next serve hashes it again
+		return nil, fmt.Errorf("%s changed while hashing", path)
+	}
+
+	if !rec.hasContentHash(expected) {
+		return nil, s.quarantine(path)
+	}
+	if force && old != nil && old.matches(fi) {
+		for name, want := range old.Digests {
+			if got, have := rec.Digests[name]; have && got != want {
+				return nil, s.quarantine(path)
+			}
+		}
+	}
+	return rec, s.save(path, rec)
+}
+
+// parseContentHash splits "sha256:9f86..." into "sha-256" and the hex digest.
+func parseContentHash(hash string) (name, digest string, ok bool) {
+	i := strings.IndexByte(hash, ':')
+	if i <= 0 {
+		return "", "", false
+	}
+	return normalizeDigestName(hash[:i]), strings.ToLower(hash[i+1:]), true
+}
+
+func (s *HashStore) compute(path string, fi os.FileInfo) (*DigestRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make([]hash.Hash, len(s.algorithms))
+	writers := make([]io.Writer, len(s.algorithms))
+	for i, name := range s.algorithms {
+		newHash, _ := digestAlgorithm(name)
+		hashes[i] = newHash()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+	rec := &DigestRecord{Size: fi.Size(), ModTime: fi.ModTime(), Digests: map[string]string{}}
+	for i, name := range s.algorithms {
+		rec.Digests[name] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	return rec, nil
+}
+
+func (s *HashStore) load(path string) (*DigestRecord, error) {
+	s.mu.Lock()
+	rec, ok := s.records[path]
+	s.mu.Unlock()
+	if ok {
+		return rec, nil
+	}
+	data, err := os.ReadFile(path + DigestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	rec = &DigestRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("%s%s: %v", path, DigestSuffix, err)
+	}
+	s.mu.Lock()
+	s.records[path] = rec
+	s.mu.Unlock()
+	return rec, nil
+}
+
+func (s *HashStore) save(path string, rec *DigestRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+DigestSuffix, data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.records[path] = rec
+	s.mu.Unlock()
+	return nil
+}
+
+// forget drops the cached record of path.
+func (s *HashStore) forget(path string) {
+	s.mu.Lock()
+	delete(s.records, path)
+	s.mu.Unlock()
+}
+
+// quarantine moves the file at path and its sidecars out of the cache and
+// returns ErrIntegrity.
+func (s *HashStore) quarantine(path string) error {
+	s.forget(path)
+	s.mu.Lock()
+	invalidate := s.invalidate
+	s.mu.Unlock()
+	prefix := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + filepath.Base(path)
+	for _, suffix := range []string{"", HeaderSuffix, DigestSuffix} {
+		src := path + suffix
+		if _, err := os.Lstat(src); err != nil {
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(s.quarantineDir, prefix+suffix)); err != nil {
+			// a quarantine dir on another device can't take a rename
+			os.Remove(src)
+		}
+		if invalidate != nil {
+			invalidate(src)
+		}
+	}
+	return ErrIntegrity
+}
+
+func (s *HashStore) setInvalidate(fn func(path string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidate = fn
+}
+
+// A ScrubReport summarizes a Scrub run.
+type ScrubReport struct {
+	// Checked counts files that were hashed and compared.
+	Checked int
+	// Skipped counts files without a digest record.
+	Skipped int
+	// Quarantined lists the files that failed verification.
+	Quarantined []string
+	// Errors maps files that couldn't be checked to the reason.
+	Errors map[string]error
+}
+
+// Scrub hashes every file below root that has a digest record and
+// quarantines the ones that don't match it, whether or not they appear
+// modified. It stops early when ctx is done.
+func (s *HashStore) Scrub(ctx context.Context, root string) (ScrubReport, error) {
+	report := ScrubReport{Errors: map[string]error{}}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// files quarantined during the walk are gone by the time it
+			// reaches their sidecars
+			if !os.IsNotExist(err) {
+				report.Errors[path] = err
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fi.IsDir() {
+			if path == s.quarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || isSidecarPath(path) {
+			return nil
+		}
+		if _, err := os.Stat(path + DigestSuffix); err != nil {
+			report.Skipped++
+			return nil
+		}
+		s.forget(path)
+		_, err = s.verify(path, fi, "", true)
+		report.Checked++
+		switch {
+		case errors.Is(err, ErrIntegrity):
+			report.Quarantined = append(report.Quarantined, path)
+		case err != nil:
+			report.Errors[path] = err
+		}
+		return nil
+	})
+	return report, err
+}
+
+// StartScrub runs Scrub on root every interval until ctx is done. Each
+// report is passed to onReport if it is not nil.
+func (s *HashStore) StartScrub(ctx context.Context, root string, interval time.Duration, onReport func(ScrubReport, error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := s.Scrub(ctx, root)
+				if onReport != nil {
+					onReport(report, err)
+				}
+			}
+		}
+	}()
+}
+
+// isSidecarPath reports whether path is a sidecar or temporary file of the
+// cache rather than a cached file.
+func isSidecarPath(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasSuffix(base, HeaderSuffix) || strings.HasSuffix(base, DigestSuffix) || strings.HasSuffix(base, PartsSuffix) ||
+		isTempPath(path)
+}
+
+// SetHashStore makes FileWithPause verify files with s before serving them
+// and send their digests in the Repr-Digest and Digest headers. s also
+// becomes the hash source of generated ETags. A nil s turns this off.
+func (hs *HttpServer) SetHashStore(s *HashStore) {
+	hs.etagMu.Lock()
+	defer hs.etagMu.Unlock()
+	if old := hs.hashStore; old != nil && old != s {
+		old.setInvalidate(nil)
+	}
+	hs.hashStore = s
+	if s != nil {
+		s.setInvalidate(hs.invalidateFile)
+		hs.hashSource = s
+	} else if _, ok := hs.hashSource.(*HashStore); ok {
+		hs.hashSource = nil
+	}
+}
+
+func (hs *HttpServer) GetHashStore() *HashStore {
+	hs.etagMu.RLock()
+	defer hs.etagMu.RUnlock()
+	return hs.hashStore
+}
@@ -0,0 +1,129 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHashStore(t *testing.T) (*HashStore, string) {
+	root := t.TempDir()
+	s, err := NewHashStore(filepath.Join(root, "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, root
+}
+
+func sha256Hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// waitVerified calls Verify until the background hash of path is recorded.
+func waitVerified(t *testing.T, s *HashStore, path, expected string) (*DigestRecord, error) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := s.Verify(path, fi, expected)
+		if rec != nil || err != nil {
+			return rec, err
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not hashed", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHashStoreRecordsReplacedFile(t *testing.T) {
+	s, root := newTestHashStore(t)
+	path := filepath.Join(root, "f")
+	if err := os.WriteFile(path, []byte("old content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Record(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaced by normal means, without Record
+	if err := os.WriteFile(path, []byte("new, longer content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	fi, _ := os.Stat(path)
+	if rec, err := s.Verify(path, fi, ""); rec != nil || err != nil {
+		t.Fatalf("first serve after the change: %v, %v; want it hashed in the background", rec, err)
+	}
+	rec, err := waitVerified(t, s, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.ContentHash(); got != sha256Hash("new, longer content") {
+		t.Errorf("recorded %s", got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("replaced file quarantined: %v", err)
+	}
+}
+
+func TestHashStoreQuarantinesExpectedMismatch(t *testing.T) {
+	s, root := newTestHashStore(t)
+
+	// a new file that doesn't match the hash its sidecar expects
+	path := filepath.Join(root, "new")
+	os.WriteFile(path, []byte("tampered"), 0644)
+	if _, err := waitVerified(t, s, path, sha256Hash("original")); !os.IsNotExist(err) {
+		t.Fatalf("new mismatching file: %v, want it quarantined", err)
+	}
+
+	// a recorded file whose record disagrees with the expected hash
+	path = filepath.Join(root, "recorded")
+	os.WriteFile(path, []byte("content"), 0644)
+	if _, err := s.Record(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(path)
+	if _, err := s.Verify(path, fi, sha256Hash("content")); err != nil {
+		t.Fatalf("matching expected hash: %v", err)
+	}
+	if _, err := s.Verify(path, fi, sha256Hash("other")); err != ErrIntegrity {
+		t.Fatalf("mismatching expected hash: %v, want %v", err, ErrIntegrity)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("mismatching file not quarantined: %v", err)
+	}
+}
+
+func TestHashStoreScrubFindsRot(t *testing.T) {
+	s, root := newTestHashStore(t)
+	path := filepath.Join(root, "f")
+	os.WriteFile(path, []byte("good data"), 0644)
+	if _, err := s.Record(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(path)
+
+	// same size and modification time, other bytes
+	os.WriteFile(path, []byte("bad! data"), 0644)
+	os.Chtimes(path, fi.ModTime(), fi.ModTime())
+	report, err := s.Scrub(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || len(report.Quarantined) != 1 || report.Quarantined[0] != path {
+		t.Errorf("report %+v", report)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("rotten file not quarantined: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package MesonTerminalEchoServer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// The .header sidecar stores a response header next to a cached file as
+// plain lines: for every key a line with the key, a line with the number of
+// values and then one line per value.
+//
+//	Content-Type
+//	1
+//	image/jpeg
+
+// HeaderSuffix is appended to a file path to name its .header sidecar.
+const HeaderSuffix = ".header"
+
+// HeaderParseOptions bounds and controls the parsing of a .header sidecar.
+// Zero limits mean the defaults.
+type HeaderParseOptions struct {
+	// MaxKeys is the most header keys accepted. Default 128.
+	MaxKeys int
+	// MaxValues is the most values accepted for one key. Default 32.
+	MaxValues int
+	// MaxSize is the largest sidecar accepted, in bytes. Default 64KB.
+	MaxSize int64
+	// BestEffort keeps the valid entries of a bad sidecar instead of
+	// rejecting all of it. Invalid entries are skipped and parsing stops
+	// at the first structural error; the error is still returned.
+	BestEffort bool
+}
+
+const (
+	defaultHeaderMaxKeys   = 128
+	defaultHeaderMaxValues = 32
+	defaultHeaderMaxSize   = 64 * 1024
+)
+
+func (o HeaderParseOptions) withDefaults() HeaderParseOptions {
+	if o.MaxKeys <= 0 {
+		o.MaxKeys = defaultHeaderMaxKeys
+	}
+	if o.MaxValues <= 0 {
+		o.MaxValues = defaultHeaderMaxValues
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = defaultHeaderMaxSize
+	}
+	return o
+}
+
+// A HeaderFileError reports a problem at a line of a .header sidecar.
+type HeaderFileError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *HeaderFileError) Error() string {
+	where := e.Path
+	if where == "" {
+		where = "header file"
+	}
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", where, e.Msg)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("header file line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+}
+
+// ReadHeaderFile reads the header from a sidecar written by WriteHeaderFile
+// or WriteSidecar. Any malformed or invalid entry makes it fail; see
+// ReadHeaderFileWithOptions.
+func ReadHeaderFile(filePath string) (map[string][]string, error) {
+	return ReadHeaderFileWithOptions(filePath, HeaderParseOptions{})
+}
+
+// ReadHeaderFileWithOptions reads the header from a sidecar in any of the
+// sidecar formats. With opts.BestEffort it may return both the valid part of
+// the header and an error.
+func ReadHeaderFileWithOptions(filePath string, opts HeaderParseOptions) (map[string][]string, error) {
+	sc, err := ReadSidecarWithOptions(filePath, opts)
+	if sc == nil {
+		return nil, err
+	}
+	return sc.Header, err
+}
+
+// ParseHeader parses the .header sidecar format from r. It rejects header
+// names that aren't HTTP tokens, values with control characters such as CR
+// or LF, and input beyond the limits of opts. Errors are *HeaderFileError
+// unless reading r failed.
+func ParseHeader(r io.Reader, opts HeaderParseOptions) (map[string][]string, error) {
+	opts = opts.withDefaults()
+	p := headerParser{
+		buf: bufio.NewReader(io.LimitReader(r, opts.MaxSize+1)),
+		max: opts.MaxSize,
+	}
+	header := map[string][]string{}
+	var firstErr error
+	fail := func(err error) (map[string][]string, error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+		if opts.BestEffort {
+			return header, firstErr
+		}
+		return nil, firstErr
+	}
+
+	for {
+		//key
+		key, ok, err := p.line()
+		if err != nil {
+			return fail(err)
+		}
+		if !ok { //read end
+			return header, firstErr
+		}
+		keyLine := p.n
+		//value count
+		countStr, ok, err := p.line()
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			return fail(p.errorf("header %q: missing value count", key))
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 0 {
+			return fail(p.errorf("header %q: bad value count %q", key, countStr))
+		}
+		if count > opts.MaxValues {
+			return fail(p.errorf("header %q: %d values, at most %d allowed", key, count, opts.MaxValues))
+		}
+
+		var entryErr error
+		if !httpguts.ValidHeaderFieldName(key) {
+			entryErr = &HeaderFileError{Line: keyLine, Msg: fmt.Sprintf("invalid header name %q", key)}
+		}
+		values := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			value, ok, err := p.line()
+			if err != nil {
+				return fail(err)
+			}
+			if !ok {
+				return fail(p.errorf("header %q: missing value %d of %d", key, i+1, count))
+			}
+			if entryErr == nil && !httpguts.ValidHeaderFieldValue(value) {
+				entryErr = p.errorf("header %q: invalid value %q", key, value)
+			}
+			values = append(values, value)
+		}
+		if entryErr != nil {
+			if !opts.BestEffort {
+				return nil, entryErr
+			}
+			if firstErr == nil {
+				firstErr = entryErr
+			}
+			continue
+		}
+		if count == 0 {
+			continue
+		}
+		if _, exist := header[key]; !exist && len(header) >= opts.MaxKeys {
+			return fail(p.errorf("more than %d header keys", opts.MaxKeys))
+		}
+		if len(header[key])+count > opts.MaxValues {
+			return fail(p.errorf("header %q: more than %d values", key, opts.MaxValues))
+		}
+		header[key] = append(header[key], values...)
+	}
+}
+
+// headerParser reads the lines of a .header sidecar and counts them.
+type headerParser struct {
+	buf  *bufio.Reader
+	n    int
+	read int64
+	max  int64
+}
+
+// line returns the next line without its line ending. ok is false at the
+// end of the input.
+func (p *headerParser) line() (line string, ok bool, err error) {
+	line, err = p.buf.ReadString('\n')
+	p.read += int64(len(line))
+	if p.read > p.max {
+		p.n++
+		return "", false, p.errorf("header file larger than %d bytes", p.max)
+	}
+	if err == io.EOF {
+		if line == "" {
+			return "", false, nil
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	p.n++
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return line, true, nil
+}
+
+func (p *headerParser) errorf(format string, args ...interface{}) *HeaderFileError {
+	return &HeaderFileError{Line: p.n, Msg: fmt.Sprintf(format, args...)}
+}
+
+// WriteHeaderFile writes header to filePath in the .header sidecar format.
+// The file is written to a temporary file in the same directory first and
+// then renamed, so readers never see a partially written sidecar.
+func WriteHeaderFile(filePath string, header map[string][]string) error {
+	var sb strings.Builder
+	if err := writeHeader(&sb, header); err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, []byte(sb.String()))
+}
+
+func writeHeader(w io.Writer, header map[string][]string) error {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range keys {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+		values := header[k]
+		fmt.Fprintf(bw, "%s\n%d\n", k, len(values))
+		for _, v := range values {
+			if !httpguts.ValidHeaderFieldValue(v) {
+				return fmt.Errorf("header %q: invalid value %q", k, v)
+			}
+			fmt.Fprintf(bw, "%s\n", v)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeFileAtomic writes data to a temporary file next to filePath and
+// renames it into place.
+func writeFileAtomic(filePath string, data []byte) error {
+	return writeFileAtomicFunc(filePath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// isTempPath reports whether path names a temporary file of
+// writeFileAtomic or of an origin download, which os.CreateTemp names
+// ".<base>.tmp<digits>".
+func isTempPath(path string) bool {
+	base := filepath.Base(path)
+	i := strings.LastIndex(base, ".tmp")
+	if !strings.HasPrefix(base, ".") || i < 2 || i+len(".tmp") == len(base) {
+		return false
+	}
+	for _, c := range base[i+len(".tmp"):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomicFunc is writeFileAtomic with the content written by write.
+func writeFileAtomicFunc(filePath string, write func(w io.Writer) error) (err error) {
+	dir, base := filepath.Split(filePath)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
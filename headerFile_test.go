@@ -0,0 +1,100 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.jpg.header")
+	header := map[string][]string{
+		"Content-Type":  {"image/jpeg"},
+		"Cache-Control": {"public", "max-age=3600"},
+		"X-Empty-Value": {""},
+		"X-Meta":        {"a: b", "c\td", "ünïcode"},
+	}
+	if err := WriteHeaderFile(path, header); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadHeaderFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, header) {
+		t.Errorf("read %v, want %v", got, header)
+	}
+}
+
+func TestHeaderFileZeroValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.header")
+	header := map[string][]string{
+		"Content-Type": {"text/plain"},
+		"X-None":       {},
+	}
+	if err := WriteHeaderFile(path, header); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("X-None\n0\n")) {
+		t.Errorf("written file %q lacks the count 0 key", data)
+	}
+	got, err := ReadHeaderFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"Content-Type": {"text/plain"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+}
+
+func TestWriteHeaderFileRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string][]string
+	}{
+		{"empty name", map[string][]string{"": {"v"}}},
+		{"space in name", map[string][]string{"Bad Name": {"v"}}},
+		{"colon in name", map[string][]string{"Bad:Name": {"v"}}},
+		{"newline in name", map[string][]string{"Bad\nName": {"v"}}},
+		{"newline in value", map[string][]string{"X-Ok": {"a\nb"}}},
+		{"carriage return in value", map[string][]string{"X-Ok": {"a\rb"}}},
+		{"nul in value", map[string][]string{"X-Ok": {"a\x00b"}}},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "f.header")
+		if err := WriteHeaderFile(path, tt.header); err == nil {
+			t.Errorf("%s: written without error", tt.name)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: file left behind: %v", tt.name, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestReadHeaderFileRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid name", "Bad Name\n1\nv\n"},
+		{"missing count", "X-Ok\n"},
+		{"bad count", "X-Ok\nx\nv\n"},
+		{"missing value", "X-Ok\n2\nv\n"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseHeader(bytes.NewReader([]byte(tt.data)), HeaderParseOptions{}); err == nil {
+			t.Errorf("%s: parsed without error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package MesonTerminalEchoServer
+
+import (
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// A HeaderPolicy decides which keys of a stored header are not sent to the
+// client. Names are matched case-insensitively. A nil *HeaderPolicy drops
+// nothing.
+//
+// The zero value ignores nothing. A HeaderPolicy must not be changed while
+// it is in use.
+type HeaderPolicy struct {
+	names    map[string]struct{}
+	prefixes []string
+	patterns []*regexp.Regexp
+}
+
+// NewHeaderPolicy returns a policy ignoring the given names. A name ending
+// in "*", such as "X-Amz-*", ignores every name with that prefix.
+func NewHeaderPolicy(names ...string) *HeaderPolicy {
+	return (&HeaderPolicy{}).Ignore(names...)
+}
+
+// Ignore adds names to p and returns p. A name ending in "*" is a prefix.
+func (p *HeaderPolicy) Ignore(names ...string) *HeaderPolicy {
+	for _, name := range names {
+		if strings.HasSuffix(name, "*") {
+			p.IgnorePrefix(strings.TrimSuffix(name, "*"))
+			continue
+		}
+		if p.names == nil {
+			p.names = map[string]struct{}{}
+		}
+		p.names[textproto.CanonicalMIMEHeaderKey(name)] = struct{}{}
+	}
+	return p
+}
+
+// IgnorePrefix makes p ignore every name starting with one of prefixes and
+// returns p.
+func (p *HeaderPolicy) IgnorePrefix(prefixes ...string) *HeaderPolicy {
+	for _, prefix := range prefixes {
+		p.prefixes = append(p.prefixes, strings.ToLower(prefix))
+	}
+	return p
+}
+
+// IgnoreRegexp makes p ignore every name matched by one of res and returns
+// p. The canonical form of the name is matched, as in "Content-Encoding".
+func (p *HeaderPolicy) IgnoreRegexp(res ...*regexp.Regexp) *HeaderPolicy {
+	p.patterns = append(p.patterns, res...)
+	return p
+}
+
+// Ignored reports whether the header name must not be sent.
+func (p *HeaderPolicy) Ignored(name string) bool {
+	if p == nil {
+		return false
+	}
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if _, ok := p.names[name]; ok {
+		return true
+	}
+	if len(p.prefixes) > 0 {
+		lower := strings.ToLower(name)
+		for _, prefix := range p.prefixes {
+			if strings.HasPrefix(lower, prefix) {
+				return true
+			}
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package MesonTerminalEchoServer
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// A HeaderAction is what a HeaderRule does to its header.
+type HeaderAction int
+
+const (
+	// HeaderSet sets the header unless the response already has it.
+	HeaderSet HeaderAction = iota
+	// HeaderOverride replaces all values of the header.
+	HeaderOverride
+	// HeaderAppend adds a value to the header.
+	HeaderAppend
+	// HeaderDelete removes the header.
+	HeaderDelete
+)
+
+// A HeaderRule changes the response header of files served by FileWithPause
+// right before the header is written.
+//
+// A rule applies when all of its non-empty match fields match. Value is a
+// template that may refer to ${node}, ${bindname}, ${path}, ${file},
+// ${status} and ${mime}.
+type HeaderRule struct {
+	// Path is a path.Match pattern for the request URL path. A pattern
+	// ending in "/**" matches everything below its directory.
+	Path string
+	// BindName must equal the bindname given with WithBindName.
+	BindName string
+	// MIMEType is a path.Match pattern for the media type of the content,
+	// as in "image/*".
+	MIMEType string
+	// Status is the status code of the response.
+	Status int
+
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// framingHeaders describe the body as serveContent sends it, so rules,
+// which run after it set them, must not change them.
+var framingHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Content-Range":     true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+}
+
+func (rule *HeaderRule) validate() error {
+	if !httpguts.ValidHeaderFieldName(rule.Name) {
+		return fmt.Errorf("header rule: invalid header name %q", rule.Name)
+	}
+	if framingHeaders[http.CanonicalHeaderKey(rule.Name)] {
+		return fmt.Errorf("header rule: %s frames the body and can't be changed", rule.Name)
+	}
+	for _, pattern := range []string{strings.TrimSuffix(rule.Path, "/**"), rule.MIMEType} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("header rule %s: bad pattern %q", rule.Name, pattern)
+		}
+	}
+	if rule.Action < HeaderSet || rule.Action > HeaderDelete {
+		return fmt.Errorf("header rule %s: unknown action %d", rule.Name, rule.Action)
+	}
+	return nil
+}
+
+func (rule *HeaderRule) match(v *headerRuleVars) bool {
+	if rule.BindName != "" && rule.BindName != v.bindName {
+		return false
+	}
+	if rule.Status != 0 && rule.Status != v.status {
+		return false
+	}
+	if rule.MIMEType != "" {
+		if ok, _ := path.Match(rule.MIMEType, v.mediaType); !ok {
+			return false
+		}
+	}
+	if rule.Path != "" && !matchPath(rule.Path, v.path) {
+		return false
+	}
+	return true
+}
+
+// matchPath is path.Match with a trailing "/**" matching any number of
+// path elements below the directory before it.
+func matchPath(pattern, name string) bool {
+	dir := strings.TrimSuffix(pattern, "/**")
+	if dir == pattern {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	// match the leading elements of name against dir
+	n := strings.Count(dir, "/") + 1
+	parts := strings.SplitN(name, "/", n+1)
+	if len(parts) <= n {
+		return false
+	}
+	ok, _ := path.Match(dir, strings.Join(parts[:n], "/"))
+	return ok
+}
+
+// A HeaderRuleSet is an ordered list of header rules. Rules run in order, so
+// a later rule sees the changes of the earlier ones.
+type HeaderRuleSet struct {
+	rules []HeaderRule
+}
+
+// NewHeaderRuleSet checks rules and returns them as a set.
+func NewHeaderRuleSet(rules ...HeaderRule) (*HeaderRuleSet, error) {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &HeaderRuleSet{rules: append([]HeaderRule(nil), rules...)}, nil
+}
+
+// headerRuleVars are the values a rule can match on and expand.
+type headerRuleVars struct {
+	node      string
+	bindName  string
+	path      string
+	file      string
+	status    int
+	mediaType string
+}
+
+func (v *headerRuleVars) expand(s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	return os.Expand(s, func(key string) string {
+		switch key {
+		case "node":
+			return v.node
+		case "bindname":
+			return v.bindName
+		case "path":
+			return v.path
+		case "file":
+			return v.file
+		case "status":
+			return strconv.Itoa(v.status)
+		case "mime":
+			return v.mediaType
+		}
+		return "${" + key + "}"
+	})
+}
+
+func (rs *HeaderRuleSet) apply(h http.Header, v *headerRuleVars) {
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		if !rule.match(v) {
+			continue
+		}
+		value := v.expand(rule.Value)
+		if !httpguts.ValidHeaderFieldValue(value) {
+			// an expanded path or file name could smuggle in a line break
+			continue
+		}
+		switch rule.Action {
+		case HeaderSet:
+			if h.Get(rule.Name) == "" {
+				h.Set(rule.Name, value)
+			}
+		case HeaderOverride:
+			h.Set(rule.Name, value)
+		case HeaderAppend:
+			h.Add(rule.Name, value)
+		case HeaderDelete:
+			h.Del(rule.Name)
+		}
+	}
+}
+
+// SetHeaderRules makes FileWithPause apply rs to every response. A nil rs
+// removes the rules.
+func (hs *HttpServer) SetHeaderRules(rs *HeaderRuleSet) {
+	hs.ruleMu.Lock()
+	defer hs.ruleMu.Unlock()
+	hs.headerRules = rs
+}
+
+func (hs *HttpServer) GetHeaderRules() *HeaderRuleSet {
+	hs.ruleMu.RLock()
+	defer hs.ruleMu.RUnlock()
+	return hs.headerRules
+}
+
+// SetNodeID sets the ID of this node, available to header rules as ${node}.
+func (hs *HttpServer) SetNodeID(id string) {
+	hs.ruleMu.Lock()
+	defer hs.ruleMu.Unlock()
+	hs.nodeID = id
+}
+
+func (hs *HttpServer) GetNodeID() string {
+	hs.ruleMu.RLock()
+	defer hs.ruleMu.RUnlock()
+	return hs.nodeID
+}
+
+// rewriteHeader applies the header rules of opts to h for a response with
+// the given status and content type.
+func (hs *HttpServer) rewriteHeader(h http.Header, r *http.Request, name, ctype string, status int, opts *serveOptions) {
+	if opts.headerRules == nil {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		mediaType = ctype
+	}
+	opts.headerRules.apply(h, &headerRuleVars{
+		node:      hs.GetNodeID(),
+		bindName:  opts.bindName,
+		path:      r.URL.Path,
+		file:      name,
+		status:    status,
+		mediaType: mediaType,
+	})
+}
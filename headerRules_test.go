@@ -0,0 +1,16 @@
+package MesonTerminalEchoServer
+
+import "testing"
+
+func TestHeaderRuleRejectsFramingHeaders(t *testing.T) {
+	for _, name := range []string{"Content-Length", "content-range", "Content-Encoding", "TRANSFER-ENCODING"} {
+		for _, action := range []HeaderAction{HeaderSet, HeaderOverride, HeaderAppend, HeaderDelete} {
+			if _, err := NewHeaderRuleSet(HeaderRule{Action: action, Name: name, Value: "x"}); err == nil {
+				t.Errorf("rule %d on %s accepted", action, name)
+			}
+		}
+	}
+	if _, err := NewHeaderRuleSet(HeaderRule{Action: HeaderSet, Name: "Cache-Control", Value: "max-age=60"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+type ioFile struct {
+	file fs.File
+}
+
+// FS converts fsys to a FileSystem implementation, for use with
+// FileWithPauseFS and ServeFileFS. Files of fsys must implement io.Seeker
+// to be served, as the files of embed.FS and os.DirFS do.
+func FS(fsys fs.FS) FileSystem {
+	return ioFS{fsys}
+}
+
+func (f ioFS) Open(name string) (File, error) {
+	// io/fs paths are unrooted and clean
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, mapOpenError(err, name, '/', func(path string) (fs.FileInfo, error) {
+			return fs.Stat(f.fsys, path)
+		})
+	}
+	if osf, ok := file.(*os.File); ok {
+		// keeps the sendfile path open for os.DirFS
+		return osf, nil
+	}
+	return ioFile{file}, nil
+}
+
+func (f ioFile) Close() error               { return f.file.Close() }
+func (f ioFile) Read(b []byte) (int, error) { return f.file.Read(b) }
+func (f ioFile) Stat() (fs.FileInfo, error) { return f.file.Stat() }
+
+var errMissingSeek = errors.New("io.File missing Seek method")
+var errMissingReadDir = errors.New("io.File directory missing ReadDir method")
+
+func (f ioFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.file.(io.Seeker)
+	if !ok {
+		return 0, errMissingSeek
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f ioFile) Readdir(count int) ([]fs.FileInfo, error) {
+	d, ok := f.file.(fs.ReadDirFile)
+	if !ok {
+		return nil, errMissingReadDir
+	}
+	var list []fs.FileInfo
+	for {
+		dirs, err := d.ReadDir(count - len(list))
+		for _, dir := range dirs {
+			info, err := dir.Info()
+			if err != nil {
+				// Pretend it doesn't exist, like (*os.File).Readdir does.
+				continue
+			}
+			list = append(list, info)
+		}
+		if err != nil {
+			return list, err
+		}
+		if count < 0 || len(list) >= count {
+			break
+		}
+	}
+	return list, nil
+}
+
+// ServeFileFS replies to the request with the contents of the file name in
+// fsys, like ServeFile does for a native path.
+func ServeFileFS(hs *HttpServer, w http.ResponseWriter, r *http.Request, fsys FileSystem, name string) TransferResult {
+	if containsDotDot(r.URL.Path) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return TransferResult{StatusCode: http.StatusBadRequest, Size: -1}
+	}
+	return serveFile(hs, w, r, fsys, name, false)
+}
+
+// A MemFS is a FileSystem holding its files in memory, for tests and for
+// small sets of generated files. Directories exist implicitly. It is safe
+// for concurrent use; files opened before a change keep their content.
+type MemFS struct {
+	mu    sync.RWMutex
+	files map[string]*memEntry
+}
+
+type memEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*memEntry{}}
+}
+
+func memPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// WriteFile stores data as the file name, replacing any earlier file. A
+// zero modTime means now. data must not be changed afterwards.
+func (m *MemFS) WriteFile(name string, data []byte, modTime time.Time) {
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[memPath(name)] = &memEntry{data: data, modTime: modTime}
+}
+
+// Remove removes the file name.
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = memPath(name)
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Open implements FileSystem.
+func (m *MemFS) Open(name string) (File, error) {
+	name = memPath(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if e, ok := m.files[name]; ok {
+		return &memFile{
+			ReadSeeker: bytes.NewReader(e.data),
+			info:       memInfo{name: path.Base(name), size: int64(len(e.data)), modTime: e.modTime},
+		}, nil
+	}
+
+	// a directory holds the files below it
+	prefix := name + "/"
+	if name == "" {
+		prefix = ""
+	}
+	children := map[string]memInfo{}
+	for p, e := range m.files {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rest := p[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			children[rest[:i]] = memInfo{name: rest[:i], dir: true, modTime: e.modTime}
+		} else {
+			children[rest] = memInfo{name: rest, size: int64(len(e.data)), modTime: e.modTime}
+		}
+	}
+	if len(children) == 0 && name != "" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.FileInfo, 0, len(children))
+	for _, fi := range children {
+		entries = append(entries, fi)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	dirName := path.Base(name)
+	if name == "" {
+		dirName = "/"
+	}
+	return &memFile{
+		ReadSeeker: strings.NewReader(""),
+		info:       memInfo{name: dirName, dir: true},
+		entries:    entries,
+	}, nil
+}
+
+type memFile struct {
+	io.ReadSeeker
+	info    memInfo
+	entries []fs.FileInfo
+}
+
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *memFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.name, Err: errors.New("not a directory")}
+	}
+	if count <= 0 {
+		list := f.entries
+		f.entries = nil
+		return list, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	list := f.entries[:count]
+	f.entries = f.entries[count:]
+	return list, nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Size() int64        { return fi.size }
+func (fi memInfo) ModTime() time.Time { return fi.modTime }
+func (fi memInfo) IsDir() bool        { return fi.dir }
+func (fi memInfo) Sys() interface{}   { return nil }
+
+func (fi memInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,43 @@
+package MesonTerminalEchoServer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestFileWithPauseFSMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	modTime := time.Date(2021, 9, 13, 18, 0, 0, 0, time.UTC)
+	fsys.WriteFile("b/hello.txt", []byte("hello, world"), modTime)
+	hs := New()
+	e := echo.New()
+
+	tests := []struct {
+		name, rng string
+		code      int
+		body      string
+	}{
+		{"b/hello.txt", "", http.StatusOK, "hello, world"},
+		{"b/hello.txt", "bytes=7-", http.StatusPartialContent, "world"},
+		{"b/missing.txt", "", http.StatusNotFound, ""},
+		{"b", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		rec := httptest.NewRecorder()
+		result, _ := FileWithPauseFS(hs, e.NewContext(req, rec), fsys, tt.name, nil, nil)
+		if result.StatusCode != tt.code {
+			t.Errorf("%s %s: status %d, want %d", tt.name, tt.rng, result.StatusCode, tt.code)
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s %s: body %q, want %q", tt.name, tt.rng, rec.Body.String(), tt.body)
+		}
+	}
+}
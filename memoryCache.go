@@ -0,0 +1,240 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// A MemoryCache keeps the bodies and parsed sidecars of small, hot files in
+// memory, so FileWithPause and ServeFile serve them without opening and
+// reading the files. Entries are checked against the file's size,
+// modification time and identity on every request and dropped when the
+// file changed. The least recently used entries go when the byte budget is
+// exceeded.
+type MemoryCache struct {
+	budget    int64
+	maxObject int64
+
+	mu     sync.Mutex
+	used   int64
+	lru    *list.List
+	items  map[string]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type memObject struct {
+	key  string
+	fi   os.FileInfo
+	cost int64
+	// data is the body of a file entry, sidecar the content of a sidecar
+	// entry.
+	data    []byte
+	sidecar *Sidecar
+}
+
+// NewMemoryCache returns a cache holding up to budget bytes, with files of
+// at most maxObject bytes; 0 means budget/16.
+func NewMemoryCache(budget, maxObject int64) *MemoryCache {
+	if maxObject <= 0 {
+		maxObject = budget / 16
+	}
+	return &MemoryCache{
+		budget:    budget,
+		maxObject: maxObject,
+		lru:       list.New(),
+		items:     map[string]*list.Element{},
+	}
+}
+
+// sameFile reports whether a and b describe the same unchanged file.
+func sameFile(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime()) && os.SameFile(a, b)
+}
+
+// get returns the entry for key if it was made from the file described by fi.
+func (mc *MemoryCache) get(key string, fi os.FileInfo) *memObject {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	el, ok := mc.items[key]
+	if !ok {
+		mc.misses++
+		return nil
+	}
+	obj := el.Value.(*memObject)
+	if !sameFile(obj.fi, fi) {
+		mc.removeElement(el)
+		mc.misses++
+		return nil
+	}
+	mc.lru.MoveToFront(el)
+	mc.hits++
+	return obj
+}
+
+func (mc *MemoryCache) put(obj *memObject) {
+	if obj.cost > mc.maxObject || obj.cost > mc.budget {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el, ok := mc.items[obj.key]; ok {
+		mc.removeElement(el)
+	}
+	mc.items[obj.key] = mc.lru.PushFront(obj)
+	mc.used += obj.cost
+	for mc.used > mc.budget {
+		mc.removeElement(mc.lru.Back())
+	}
+}
+
+func (mc *MemoryCache) removeElement(el *list.Element) {
+	obj := mc.lru.Remove(el).(*memObject)
+	delete(mc.items, obj.key)
+	mc.used -= obj.cost
+}
+
+// Invalidate drops the entries of the file at filePath and of a sidecar at
+// filePath.
+func (mc *MemoryCache) Invalidate(filePath string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, key := range []string{"body:" + filePath, "sidecar:" + filePath} {
+		if el, ok := mc.items[key]; ok {
+			mc.removeElement(el)
+		}
+	}
+}
+
+// Purge drops all entries.
+func (mc *MemoryCache) Purge() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.lru.Init()
+	mc.items = map[string]*list.Element{}
+	mc.used = 0
+}
+
+// Stats returns the number of lookups that were served from memory and that
+// weren't, and the bytes held.
+func (mc *MemoryCache) Stats() (hits, misses uint64, used int64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.hits, mc.misses, mc.used
+}
+
+// SetMemoryCache puts mc in front of the files served by FileWithPause and
+// ServeFile from the native file system. A nil mc removes it.
+func (hs *HttpServer) SetMemoryCache(mc *MemoryCache) {
+	hs.etagMu.Lock()
+	defer hs.etagMu.Unlock()
+	hs.memoryCache = mc
+}
+
+func (hs *HttpServer) GetMemoryCache() *MemoryCache {
+	hs.etagMu.RLock()
+	defer hs.etagMu.RUnlock()
+	return hs.memoryCache
+}
+
+// openFile opens name in fsys, from the memory cache if it holds the file or
+// through the fd cache for a file too large for the memory cache. Files of
+// a contextFileSystem are opened with ctx.
+func (hs *HttpServer) openFile(ctx context.Context, fsys FileSystem, name string) (File, error) {
+	if cfs, ok := fsys.(contextFileSystem); ok {
+		return cfs.OpenContext(ctx, name)
+	}
+	mc, fc := hs.GetMemoryCache(), hs.GetFDCache()
+	filePath := dirPath(fsys, name)
+	if mc == nil && fc == nil || filePath == "" {
+		return fsys.Open(name)
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return fsys.Open(name)
+	}
+	if mc == nil || fi.Size() > mc.maxObject {
+		if fc != nil {
+			return fc.open(filePath, fi)
+		}
+		return fsys.Open(name)
+	}
+	key := "body:" + filePath
+	if obj := mc.get(key, fi); obj != nil {
+		return &cachedFile{Reader: bytes.NewReader(obj.data), fi: obj.fi}, nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	ofi, err := f.Stat()
+	if err != nil || !sameFile(fi, ofi) {
+		// replaced since the Stat above
+		return f, nil
+	}
+	data := make([]byte, ofi.Size())
+	if _, err := io.ReadFull(f, data); err == nil {
+		mc.put(&memObject{key: key, fi: ofi, cost: int64(len(data)), data: data})
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// invalidateFile drops what the caches of hs hold of the file at filePath,
+// after it was removed or replaced. The file may be a sidecar.
+func (hs *HttpServer) invalidateFile(filePath string) {
+	if mc := hs.GetMemoryCache(); mc != nil {
+		mc.Invalidate(filePath)
+	}
+	if fc := hs.GetFDCache(); fc != nil {
+		fc.Invalidate(filePath)
+	}
+	if s := hs.GetHashStore(); s != nil {
+		s.forget(filePath)
+	}
+}
+
+// readSidecar reads the sidecar at filePath, from the memory cache if it
+// holds the sidecar. The returned sidecar must not be changed.
+func (hs *HttpServer) readSidecar(filePath string, opts HeaderParseOptions) (*Sidecar, error) {
+	mc := hs.GetMemoryCache()
+	if mc == nil {
+		return ReadSidecarWithOptions(filePath, opts)
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	key := "sidecar:" + filePath
+	if obj := mc.get(key, fi); obj != nil {
+		return obj.sidecar, nil
+	}
+	sc, err := ReadSidecarWithOptions(filePath, opts)
+	if err == nil {
+		mc.put(&memObject{key: key, fi: fi, cost: fi.Size(), sidecar: sc})
+	}
+	return sc, err
+}
+
+// A cachedFile serves a file body held by the memory cache.
+type cachedFile struct {
+	*bytes.Reader
+	fi os.FileInfo
+}
+
+func (f *cachedFile) Close() error               { return nil }
+func (f *cachedFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+func (f *cachedFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.fi.Name(), Err: errors.New("not a directory")}
+}
@@ -0,0 +1,415 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// An OriginConfig tells FileWithPause where to fetch the missing files of a
+// bindname from.
+type OriginConfig struct {
+	// BaseURL is prepended to the origin path of a file, as given with
+	// WithOriginPath.
+	BaseURL string
+	// Client is used for the fetches; nil means http.DefaultClient.
+	Client *http.Client
+	// Header is added to every origin request.
+	Header http.Header
+	// Timeout bounds a whole fetch, 0 means no limit.
+	Timeout time.Duration
+	// StorePolicy drops origin header keys from the stored sidecar, on top
+	// of the hop-by-hop headers that are never stored.
+	StorePolicy *HeaderPolicy
+	// SidecarFormat is the format of the stored sidecar. Default JSON.
+	SidecarFormat SidecarFormat
+}
+
+// SetOrigin makes FileWithPause fetch the missing files of bindName from
+// cfg, for calls with WithBindName and WithOriginPath. A nil cfg removes
+// the origin.
+func (hs *HttpServer) SetOrigin(bindName string, cfg *OriginConfig) {
+	hs.originMu.Lock()
+	defer hs.originMu.Unlock()
+	if cfg == nil {
+		delete(hs.origins, bindName)
+		return
+	}
+	if hs.origins == nil {
+		hs.origins = map[string]*OriginConfig{}
+	}
+	hs.origins[bindName] = cfg.normalized()
+}
+
+// normalized returns a copy of cfg with the defaults filled in.
+func (cfg *OriginConfig) normalized() *OriginConfig {
+	c := *cfg
+	if c.SidecarFormat == SidecarLegacy {
+		c.SidecarFormat = SidecarJSON
+	}
+	return &c
+}
+
+func (hs *HttpServer) GetOrigin(bindName string) *OriginConfig {
+	hs.originMu.RLock()
+	defer hs.originMu.RUnlock()
+	return hs.origins[bindName]
+}
+
+// hopHeaders are never stored from an origin response, since they only
+// describe the connection or that one response.
+var hopHeaders = NewHeaderPolicy(
+	"Age",
+	"Date",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-*",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+	"Set-Cookie",
+)
+
+// An originError is a fetch the origin didn't answer with 200.
+type originError struct {
+	url    string
+	status int
+}
+
+func (e *originError) Error() string {
+	return fmt.Sprintf("origin %s: status %d", e.url, e.status)
+}
+
+// A download fetches a file from its origin into a temporary file next to
+// it. Clients are served from the temporary file while it grows. On success
+// the sidecar is written and the file renamed into place.
+type download struct {
+	hs       *HttpServer
+	filePath string
+	bindName string
+
+	// ready is closed once header, size and modTime are set or err is.
+	ready   chan struct{}
+	header  http.Header
+	size    int64
+	modTime time.Time
+
+	mu sync.Mutex
+	// file is the temporary file, set once the origin answered.
+	file *os.File
+	// notify is closed and replaced whenever written or done changes.
+	notify  chan struct{}
+	written int64
+	done    bool
+	err     error
+	refs    int
+}
+
+// download returns the running download of filePath, starting it if there is
+// none, so concurrent requests share one origin fetch. The caller must
+// release it.
+func (hs *HttpServer) download(cfg *OriginConfig, bindName, filePath, sidecarPath, originPath string) *download {
+	hs.originMu.Lock()
+	defer hs.originMu.Unlock()
+	if d, ok := hs.downloads[filePath]; ok {
+		d.mu.Lock()
+		d.refs++
+		d.mu.Unlock()
+		return d
+	}
+	if hs.downloads == nil {
+		hs.downloads = map[string]*download{}
+	}
+	d := &download{hs: hs, filePath: filePath, bindName: bindName, ready: make(chan struct{}), notify: make(chan struct{}), size: -1, refs: 2}
+	hs.downloads[filePath] = d
+	go d.run(cfg, sidecarPath, originPath)
+	return d
+}
+
+func (d *download) release() {
+	d.mu.Lock()
+	d.refs--
+	f := d.file
+	last := d.refs == 0
+	d.mu.Unlock()
+	if last && f != nil {
+		f.Close()
+	}
+}
+
+func (d *download) run(cfg *OriginConfig, sidecarPath, originPath string) {
+	defer d.release()
+	readyOnce := sync.Once{}
+	markReady := func() { readyOnce.Do(func() { close(d.ready) }) }
+
+	err := d.fetch(cfg, sidecarPath, originPath, markReady)
+
+	d.hs.originMu.Lock()
+	delete(d.hs.downloads, d.filePath)
+	d.hs.originMu.Unlock()
+
+	d.mu.Lock()
+	d.done, d.err = true, err
+	d.wake()
+	d.mu.Unlock()
+	markReady()
+}
+
+// wake wakes the readers waiting for progress. d.mu must be held.
+func (d *download) wake() {
+	close(d.notify)
+	d.notify = make(chan struct{})
+}
+
+func (d *download) fetch(cfg *OriginConfig, sidecarPath, originPath string, markReady func()) (err error) {
+	ctx, cancel := d.hs.transferContext(context.Background())
+	defer cancel()
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	u := strings.TrimSuffix(cfg.BaseURL, "/") + (&url.URL{Path: path.Clean("/" + originPath)}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Header {
+		req.Header[k] = v
+	}
+	// the file is stored as is, so ask for it unencoded
+	req.Header.Set("Accept-Encoding", "identity")
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &originError{url: u, status: resp.StatusCode}
+	}
+
+	dir, base := filepath.Split(d.filePath)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	header := http.Header{}
+	addHeader(header, resp.Header, hopHeaders)
+	for k := range header {
+		if cfg.StorePolicy.Ignored(k) {
+			header.Del(k)
+		}
+	}
+	d.mu.Lock()
+	d.file = f
+	d.mu.Unlock()
+	d.header = header
+	d.size = resp.ContentLength
+	d.modTime = time.Now()
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		d.modTime = lm
+	}
+	markReady()
+
+	hash := sha256.New()
+	buf := make([]byte, 32*1024)
+	for {
+		n, er := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			hash.Write(buf[:n])
+			d.mu.Lock()
+			d.written += int64(n)
+			d.wake()
+			d.mu.Unlock()
+		}
+		if er == io.EOF {
+			break
+		}
+		if er != nil {
+			return er
+		}
+	}
+	if d.size >= 0 && d.written != d.size {
+		return fmt.Errorf("origin %s: got %d of %d bytes", u, d.written, d.size)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	os.Chtimes(f.Name(), d.modTime, d.modTime)
+
+	fetchedAt := time.Now().UTC()
+	sc := &Sidecar{
+		Header:      header,
+		OriginURL:   u,
+		FetchedAt:   &fetchedAt,
+		ContentHash: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:        d.written,
+		Status:      resp.StatusCode,
+	}
+	if err := WriteSidecar(sidecarPath, sc, cfg.SidecarFormat); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), d.filePath); err != nil {
+		return err
+	}
+	d.hs.invalidateFile(d.filePath)
+	d.hs.invalidateFile(sidecarPath)
+	if store := d.hs.GetHashStore(); store != nil {
+		store.Record(d.filePath)
+	}
+	if ci := d.hs.GetCacheIndex(); ci != nil {
+		ci.Touch(d.filePath, d.bindName, d.written)
+	}
+	return nil
+}
+
+// downloadReader reads a download as it grows. Reads past the downloaded
+// part wait for it until ctx is done.
+type downloadReader struct {
+	ctx context.Context
+	d   *download
+	off int64
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	d := r.d
+	var written int64
+	var done bool
+	var err error
+	var f *os.File
+	for {
+		d.mu.Lock()
+		written, done, err, f = d.written, d.done, d.err, d.file
+		notify := d.notify
+		d.mu.Unlock()
+		if r.off < written || done {
+			break
+		}
+		select {
+		case <-notify:
+		case <-r.ctx.Done():
+			if d.hs.isClosing() {
+				return 0, ErrServerClosing
+			}
+			return 0, r.ctx.Err()
+		}
+	}
+	if r.off >= written {
+		if done && err == nil {
+			return 0, io.EOF
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if avail := written - r.off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+var errDownloadSeek = errors.New("download of unknown size can't seek from the end")
+
+func (r *downloadReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		if r.d.size < 0 {
+			return 0, errDownloadSeek
+		}
+		offset += r.d.size
+	default:
+		return 0, errors.New("download: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("download: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// serveFromOrigin serves the missing file at filePath from its origin while
+// storing it.
+func (hs *HttpServer) serveFromOrigin(c echo.Context, cfg *OriginConfig, filePath string, header map[string][]string, policy *HeaderPolicy, o *serveOptions) (TransferResult, error) {
+	sidecarPath := o.sidecarPath
+	if sidecarPath == "" {
+		sidecarPath = filePath + HeaderSuffix
+	}
+	d := hs.download(cfg, o.bindName, filePath, sidecarPath, o.originPath)
+	defer d.release()
+	ctx, cancel := hs.transferContext(c.Request().Context())
+	defer cancel()
+	select {
+	case <-d.ready:
+	case <-ctx.Done():
+		// the download goes on for the other clients and the cache
+		err := ErrClientGone
+		if hs.isClosing() {
+			err = ErrServerClosing
+		}
+		return TransferResult{StatusCode: http.StatusServiceUnavailable, Size: -1, Err: err}, echo.NewHTTPError(http.StatusServiceUnavailable)
+	}
+
+	d.mu.Lock()
+	err, started := d.err, d.file != nil
+	d.mu.Unlock()
+	if !started {
+		var oe *originError
+		if errors.As(err, &oe) && oe.status == http.StatusNotFound {
+			return TransferResult{StatusCode: http.StatusNotFound, Size: -1}, echo.NotFoundHandler(c)
+		}
+		c.Logger().Warnf("origin pull %s: %v", filePath, err)
+		return TransferResult{StatusCode: http.StatusBadGateway, Size: -1}, echo.NewHTTPError(http.StatusBadGateway)
+	}
+
+	addHeader(c.Response().Header(), d.header, policy)
+	addHeader(c.Response().Header(), header, policy)
+	sizeFunc := func() (int64, error) { return d.size, nil }
+	result := serveContent(hs, c.Response(), c.Request(), filepath.Base(filePath), d.modTime, sizeFunc, &downloadReader{ctx: ctx, d: d}, o)
+	return result, result.Err
+}
@@ -0,0 +1,199 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newOriginServer returns a server for the files of root/b, fetching the
+// missing ones from origin.
+func newOriginServer(t *testing.T, root string, origin *httptest.Server) *HttpServer {
+	hs := New()
+	hs.SetOrigin("b", &OriginConfig{BaseURL: origin.URL})
+	hs.GET("/b/*", func(c echo.Context) error {
+		name := c.Param("*")
+		filePath := filepath.Join(root, "b", filepath.FromSlash(name))
+		_, err := FileWithPause(hs, c, filePath, nil, nil,
+			WithBindName("b"), WithOriginPath(name), WithSidecar(filePath+HeaderSuffix, HeaderParseOptions{}))
+		return err
+	})
+	t.Cleanup(hs.CloseServer)
+	return hs
+}
+
+func TestOriginPullCoalesced(t *testing.T) {
+	body := bytes.Repeat([]byte("origin body "), 10000)
+	var fetches int32
+	gate := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path != "/dir/movie.mp4" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("X-Origin", "yes")
+		w.Header().Set("Last-Modified", "Mon, 13 Sep 2021 18:00:00 GMT")
+		<-gate
+		w.Write(body)
+	}))
+	defer origin.Close()
+	root := t.TempDir()
+	hs := newOriginServer(t, root, origin)
+
+	const clients = 8
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, clients)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			hs.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/b/dir/movie.mp4", nil))
+		}(recs[i])
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("origin fetched %d times, want 1", n)
+	}
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), body) {
+			t.Errorf("client %d: status %d, %d bytes", i, rec.Code, rec.Body.Len())
+		}
+		if got := rec.Header().Get("X-Origin"); got != "yes" {
+			t.Errorf("client %d: X-Origin %q", i, got)
+		}
+	}
+
+	filePath := filepath.Join(root, "b", "dir", "movie.mp4")
+	stored, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(stored, body) {
+		t.Fatalf("stored body: %d bytes, %v", len(stored), err)
+	}
+	sc, err := ReadSidecar(filePath + HeaderSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Size != int64(len(body)) || sc.OriginURL != origin.URL+"/dir/movie.mp4" || sc.ContentHash == "" {
+		t.Errorf("sidecar %+v", sc)
+	}
+	if got := http.Header(sc.Header).Get("X-Origin"); got != "yes" {
+		t.Errorf("sidecar X-Origin %q", got)
+	}
+	if _, ok := sc.Header["Date"]; ok {
+		t.Error("sidecar stores the origin Date")
+	}
+
+	// served from disk from now on
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/b/dir/movie.mp4", nil)
+	req.Header.Set("Range", "bytes=0-5")
+	hs.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "origin" {
+		t.Errorf("range from disk: %d %q", rec.Code, rec.Body.String())
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("origin fetched %d times after a disk hit, want 1", n)
+	}
+}
+
+func TestOriginPullNotFound(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+	root := t.TempDir()
+	hs := newOriginServer(t, root, origin)
+	rec := httptest.NewRecorder()
+	hs.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/b/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b", "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file stored: %v", err)
+	}
+}
+
+func TestOriginPullClientGoneWhileOriginStalls(t *testing.T) {
+	stall := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("0123456789"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+	defer close(stall)
+	hs := newOriginServer(t, t.TempDir(), origin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/b/slow", nil).WithContext(ctx)
+		hs.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still blocked after the client went away")
+	}
+}
+
+func TestOriginPullClientGoneBeforeOriginAnswers(t *testing.T) {
+	answer := make(chan struct{})
+	fetched := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(fetched)
+		<-answer
+		w.Write([]byte("late body"))
+	}))
+	defer origin.Close()
+	root := t.TempDir()
+	hs := newOriginServer(t, root, origin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/b/late", nil).WithContext(ctx)
+		hs.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// the client releases the download while the origin is about to answer
+	cancel()
+	<-done
+	close(answer)
+	<-fetched
+
+	filePath := filepath.Join(root, "b", "late")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if b, err := os.ReadFile(filePath); err == nil {
+			if string(b) != "late body" {
+				t.Fatalf("stored %q", b)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("download not stored after the client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,529 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartsSuffix is appended to the path of a partially cached object to name
+// the sidecar recording which of its chunks are present.
+const PartsSuffix = ".parts"
+
+// A RangeFetcher fetches byte ranges of objects from an origin.
+type RangeFetcher interface {
+	// FetchRange returns the bytes [off, off+length) of the object name,
+	// or fewer at its end, and the size of the whole object.
+	FetchRange(ctx context.Context, name string, off, length int64) (body io.ReadCloser, size int64, err error)
+}
+
+// ErrOriginChanged is returned when the size of an object at the origin no
+// longer matches its partially cached copy. The cached parts are dropped.
+var ErrOriginChanged = errors.New("object changed at the origin")
+
+// An HTTPRangeFetcher fetches ranges with HTTP Range requests to BaseURL
+// followed by the object name.
+type HTTPRangeFetcher struct {
+	BaseURL string
+	// Client is used for the requests; nil means http.DefaultClient.
+	Client *http.Client
+	// Header is added to every request, for example for authorization.
+	Header http.Header
+}
+
+func (hf *HTTPRangeFetcher) FetchRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, int64, error) {
+	u := strings.TrimSuffix(hf.BaseURL, "/") + (&url.URL{Path: path.Clean("/" + name)}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, v := range hf.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	client := hf.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != off {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("%s: bad Content-Range %q", u, resp.Header.Get("Content-Range"))
+		}
+		return resp.Body, size, nil
+	case http.StatusOK:
+		// the origin ignored the range
+		if resp.ContentLength < 0 {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("%s: no ranges and no Content-Length", u)
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		return readCloser{io.LimitReader(resp.Body, length), resp.Body}, resp.ContentLength, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// an empty object has no bytes to fetch a range of
+		if off == 0 && resp.Header.Get("Content-Range") == "bytes */0" {
+			resp.Body.Close()
+			return io.NopCloser(strings.NewReader("")), 0, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, 0, fmt.Errorf("%s: %s", u, resp.Status)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// parseContentRange parses "bytes start-end/size" with a known size.
+func parseContentRange(s string) (start, size int64, err error) {
+	s = strings.TrimPrefix(s, "bytes ")
+	i := strings.IndexByte(s, '-')
+	j := strings.IndexByte(s, '/')
+	if i < 0 || j < i {
+		return 0, 0, errors.New("bad Content-Range")
+	}
+	if start, err = strconv.ParseInt(s[:i], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if size, err = strconv.ParseInt(s[j+1:], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return start, size, nil
+}
+
+// A PartialStore is a FileSystem caching objects of an origin chunk by chunk.
+// Reading a file fetches the chunks it covers from the origin unless they
+// are present, so a range of a large object can be served without
+// fetching the rest of it. Objects are kept in sparse files below root with
+// a .parts sidecar holding the bitmap of present chunks.
+type PartialStore struct {
+	root      string
+	chunkSize int64
+	fetcher   RangeFetcher
+
+	mu      sync.Mutex
+	objects map[string]*partialObject
+	// fetches are shared by the readers waiting for them and run on ctx,
+	// which Close cancels.
+	flight flightGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewPartialStore returns a store in root fetching missing chunks of
+// chunkSize bytes, or DefaultChunkSize for 0, with fetcher.
+func NewPartialStore(root string, chunkSize int64, fetcher RangeFetcher) (*PartialStore, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PartialStore{root: root, chunkSize: chunkSize, fetcher: fetcher, objects: map[string]*partialObject{}, ctx: ctx, cancel: cancel}, nil
+}
+
+// Close cancels the running fetches. Reads needing a missing chunk fail
+// from then on.
+func (s *PartialStore) Close() error {
+	s.cancel()
+	return nil
+}
+
+// partialObject is the state of one cached object, shared by its open
+// files.
+type partialObject struct {
+	path string
+
+	mu    sync.RWMutex
+	parts partsRecord
+	// stale is set once the object changed at the origin; its open files
+	// fail from then on.
+	stale bool
+}
+
+// partsRecord is the content of a .parts sidecar.
+type partsRecord struct {
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunk_size"`
+	ModTime   time.Time `json:"mtime"`
+	// Present has bit i%64 of word i/64 set if chunk i is stored.
+	Present []uint64 `json:"present"`
+}
+
+func (p *partsRecord) chunks() int {
+	return int((p.Size + p.ChunkSize - 1) / p.ChunkSize)
+}
+
+func (p *partsRecord) has(i int) bool {
+	return p.Present[i/64]&(1<<(uint(i)%64)) != 0
+}
+
+func (p *partsRecord) count() int {
+	n := 0
+	for _, w := range p.Present {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+func (s *PartialStore) objectPath(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(objectKey(name)))
+}
+
+func objectKey(name string) string {
+	return path.Clean("/" + name)
+}
+
+// object returns the state of the object name, loading it from disk or
+// fetching its first chunk to learn its size. It gives up when ctx is done.
+func (s *PartialStore) object(ctx context.Context, name string) (*partialObject, error) {
+	key := objectKey(name)
+	s.mu.Lock()
+	obj, ok := s.objects[key]
+	s.mu.Unlock()
+	if ok {
+		return obj, nil
+	}
+	v, err := s.flight.doContext(ctx, s.ctx, "open:"+key, func(ctx context.Context) (interface{}, error) {
+		obj := &partialObject{path: s.objectPath(name)}
+		if data, err := os.ReadFile(obj.path + PartsSuffix); err == nil {
+			if err := json.Unmarshal(data, &obj.parts); err == nil && obj.parts.ChunkSize > 0 &&
+				len(obj.parts.Present) == (obj.parts.chunks()+63)/64 {
+				// the data file may have been removed without its sidecar
+				if fi, err := os.Stat(obj.path); err == nil && fi.Size() == obj.parts.Size {
+					s.remember(key, obj)
+					return obj, nil
+				}
+			}
+		}
+		if err := s.reset(ctx, obj, name); err != nil {
+			return nil, err
+		}
+		s.remember(key, obj)
+		return obj, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*partialObject), nil
+}
+
+func (s *PartialStore) remember(key string, obj *partialObject) {
+	s.mu.Lock()
+	s.objects[key] = obj
+	s.mu.Unlock()
+}
+
+// forget drops obj from the objects of s and reports whether it was still
+// the one of key, rather than already replaced by a newer one.
+func (s *PartialStore) forget(key string, obj *partialObject) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects[key] != obj {
+		return false
+	}
+	delete(s.objects, key)
+	return true
+}
+
+// reset starts the cached copy of obj over from the first chunk.
+func (s *PartialStore) reset(ctx context.Context, obj *partialObject, name string) error {
+	body, size, err := s.fetcher.FetchRange(ctx, name, 0, s.chunkSize)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(filepath.Dir(obj.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(obj.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	parts := partsRecord{Size: size, ChunkSize: s.chunkSize, ModTime: time.Now()}
+	parts.Present = make([]uint64, (parts.chunks()+63)/64)
+	var chunk []byte
+	if size > 0 {
+		if chunk, err = readChunk(&parts, 0, body); err != nil {
+			return err
+		}
+	}
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.parts = parts
+	if size > 0 {
+		if err := obj.storeChunk(f, 0, chunk); err != nil {
+			return err
+		}
+	}
+	return obj.saveParts()
+}
+
+// readChunk reads chunk i of an object with parts p from r.
+func readChunk(p *partsRecord, i int, r io.Reader) ([]byte, error) {
+	length := p.ChunkSize
+	if off := int64(i) * p.ChunkSize; off+length > p.Size {
+		length = p.Size - off
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// storeChunk writes chunk i into f and marks it present. obj.mu must be
+// held.
+func (obj *partialObject) storeChunk(f *os.File, i int, chunk []byte) error {
+	if _, err := f.WriteAt(chunk, int64(i)*obj.parts.ChunkSize); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	obj.parts.Present[i/64] |= 1 << (uint(i) % 64)
+	return nil
+}
+
+func (obj *partialObject) saveParts() error {
+	data, err := json.Marshal(&obj.parts)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(obj.path+PartsSuffix, data)
+}
+
+// fill makes sure chunk i of the object name is present. Readers of the
+// same chunk share one fetch; each gives up when its ctx is done.
+func (s *PartialStore) fill(ctx context.Context, obj *partialObject, name string, i int) error {
+	obj.mu.RLock()
+	present, stale := obj.parts.has(i), obj.stale
+	obj.mu.RUnlock()
+	if stale {
+		return ErrOriginChanged
+	}
+	if present {
+		return nil
+	}
+	_, err := s.flight.doContext(ctx, s.ctx, obj.path+"#"+strconv.Itoa(i), func(ctx context.Context) (interface{}, error) {
+		obj.mu.RLock()
+		parts := obj.parts
+		present, stale := parts.has(i), obj.stale
+		obj.mu.RUnlock()
+		if stale {
+			return nil, ErrOriginChanged
+		}
+		if present {
+			return nil, nil
+		}
+		body, originSize, err := s.fetcher.FetchRange(ctx, name, int64(i)*parts.ChunkSize, parts.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		if originSize != parts.Size {
+			obj.mu.Lock()
+			obj.stale = true
+			obj.mu.Unlock()
+			// a newer object already owns the sidecar otherwise
+			if s.forget(objectKey(name), obj) {
+				os.Remove(obj.path + PartsSuffix)
+			}
+			return nil, ErrOriginChanged
+		}
+		chunk, err := readChunk(&parts, i, body)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(obj.path, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		obj.mu.Lock()
+		defer obj.mu.Unlock()
+		if err := obj.storeChunk(f, i, chunk); err != nil {
+			return nil, err
+		}
+		return nil, obj.saveParts()
+	})
+	return err
+}
+
+// Fill fetches the missing chunks covering [off, off+length) of the object
+// name, for example to prefetch the start of a video.
+func (s *PartialStore) Fill(ctx context.Context, name string, off, length int64) error {
+	obj, err := s.object(ctx, name)
+	if err != nil {
+		return err
+	}
+	obj.mu.RLock()
+	size, chunkSize := obj.parts.Size, obj.parts.ChunkSize
+	obj.mu.RUnlock()
+	if off+length > size {
+		length = size - off
+	}
+	for i := off / chunkSize; length > 0 && i*chunkSize < off+length; i++ {
+		if err := s.fill(ctx, obj, name, int(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Present reports how many of the chunks of the object name are cached,
+// without fetching anything. ok is false if nothing of it is cached.
+func (s *PartialStore) Present(name string) (present, total int, ok bool) {
+	s.mu.Lock()
+	obj, ok := s.objects[objectKey(name)]
+	s.mu.Unlock()
+	if !ok {
+		data, err := os.ReadFile(s.objectPath(name) + PartsSuffix)
+		if err != nil {
+			return 0, 0, false
+		}
+		var parts partsRecord
+		if err := json.Unmarshal(data, &parts); err != nil || parts.ChunkSize <= 0 {
+			return 0, 0, false
+		}
+		return parts.count(), parts.chunks(), true
+	}
+	obj.mu.RLock()
+	defer obj.mu.RUnlock()
+	return obj.parts.count(), obj.parts.chunks(), true
+}
+
+// Open implements FileSystem. Missing chunks are fetched as the file is
+// read, until the store is closed. FileWithPauseFS opens with OpenContext
+// instead.
+func (s *PartialStore) Open(name string) (File, error) {
+	return s.OpenContext(context.Background(), name)
+}
+
+// OpenContext is like Open, but reads stop waiting for missing chunks once
+// ctx is done.
+func (s *PartialStore) OpenContext(ctx context.Context, name string) (File, error) {
+	obj, err := s.object(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(obj.path)
+	if os.IsNotExist(err) {
+		// removed underneath; start over
+		s.forget(objectKey(name), obj)
+		if obj, err = s.object(ctx, name); err != nil {
+			return nil, err
+		}
+		f, err = os.Open(obj.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj.mu.RLock()
+	info := partialInfo{name: path.Base(objectKey(name)), size: obj.parts.Size, modTime: obj.parts.ModTime}
+	obj.mu.RUnlock()
+	return &partialFile{store: s, ctx: ctx, name: name, obj: obj, f: f, info: info}, nil
+}
+
+// A partialFile reads a cached object, fetching missing chunks first.
+type partialFile struct {
+	store *PartialStore
+	ctx   context.Context
+	name  string
+	obj   *partialObject
+	f     *os.File
+	info  partialInfo
+	off   int64
+}
+
+func (pf *partialFile) Read(p []byte) (int, error) {
+	if pf.off >= pf.info.size {
+		return 0, io.EOF
+	}
+	pf.obj.mu.RLock()
+	chunkSize := pf.obj.parts.ChunkSize
+	pf.obj.mu.RUnlock()
+	i := pf.off / chunkSize
+	if err := pf.store.fill(pf.ctx, pf.obj, pf.name, int(i)); err != nil {
+		return 0, err
+	}
+	// read no further than the chunk just made present
+	if end := (i + 1) * chunkSize; pf.off+int64(len(p)) > end {
+		p = p[:end-pf.off]
+	}
+	if rest := pf.info.size - pf.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := pf.f.ReadAt(p, pf.off)
+	pf.off += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (pf *partialFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pf.off
+	case io.SeekEnd:
+		offset += pf.info.size
+	default:
+		return 0, errors.New("partial store: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("partial store: negative position")
+	}
+	pf.off = offset
+	return offset, nil
+}
+
+func (pf *partialFile) Close() error               { return pf.f.Close() }
+func (pf *partialFile) Stat() (fs.FileInfo, error) { return pf.info, nil }
+
+func (pf *partialFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: pf.name, Err: errors.New("not a directory")}
+}
+
+type partialInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi partialInfo) Name() string       { return fi.name }
+func (fi partialInfo) Size() int64        { return fi.size }
+func (fi partialInfo) Mode() fs.FileMode  { return 0444 }
+func (fi partialInfo) ModTime() time.Time { return fi.modTime }
+func (fi partialInfo) IsDir() bool        { return false }
+func (fi partialInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,296 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedFetcher serves ranges of data. Fetches of offsets other than 0 wait
+// for gate, or for their context.
+type gatedFetcher struct {
+	data []byte
+	gate chan struct{}
+
+	mu        sync.Mutex
+	fetches   int
+	cancelled int
+}
+
+func (gf *gatedFetcher) FetchRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, int64, error) {
+	gf.mu.Lock()
+	gf.fetches++
+	gf.mu.Unlock()
+	if off > 0 {
+		select {
+		case <-gf.gate:
+		case <-ctx.Done():
+			gf.mu.Lock()
+			gf.cancelled++
+			gf.mu.Unlock()
+			return nil, 0, ctx.Err()
+		}
+	}
+	end := off + length
+	if end > int64(len(gf.data)) {
+		end = int64(len(gf.data))
+	}
+	return io.NopCloser(bytes.NewReader(gf.data[off:end])), int64(len(gf.data)), nil
+}
+
+func (gf *gatedFetcher) counts() (fetches, cancelled int) {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	return gf.fetches, gf.cancelled
+}
+
+func newGatedStore(t *testing.T) (*PartialStore, *gatedFetcher) {
+	gf := &gatedFetcher{data: bytes.Repeat([]byte("0123456789abcdef"), 4), gate: make(chan struct{})}
+	s, err := NewPartialStore(t.TempDir(), 16, gf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, gf
+}
+
+func readChunkAt(ctx context.Context, s *PartialStore, off int64) ([]byte, error) {
+	f, err := s.OpenContext(ctx, "b/obj")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(f, buf)
+	return buf, err
+}
+
+func TestPartialStoreWaiterCancelDoesNotFailOthers(t *testing.T) {
+	s, gf := newGatedStore(t)
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	var got []byte
+	go func() {
+		_, err := readChunkAt(ctx1, s, 16)
+		errs <- err
+	}()
+	go func() {
+		b, err := readChunkAt(context.Background(), s, 16)
+		got = b
+		errs <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel1()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled reader got %v", err)
+	}
+	close(gf.gate)
+	if err := <-errs; err != nil {
+		t.Fatalf("other reader failed: %v", err)
+	}
+	if !bytes.Equal(got, gf.data[16:32]) {
+		t.Errorf("read %q, want %q", got, gf.data[16:32])
+	}
+	if fetches, cancelled := gf.counts(); fetches != 2 || cancelled != 0 {
+		t.Errorf("%d fetches with %d cancelled, want 2 with none cancelled", fetches, cancelled)
+	}
+}
+
+func TestPartialStoreFetchCancelledWhenAllWaitersLeave(t *testing.T) {
+	s, gf := newGatedStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := readChunkAt(ctx, s, 32)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("reader got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, cancelled := gf.counts(); cancelled == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("origin fetch not cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPartialStoreClose(t *testing.T) {
+	s, gf := newGatedStore(t)
+	done := make(chan error)
+	go func() {
+		_, err := readChunkAt(context.Background(), s, 48)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("reader got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still blocked after Close")
+	}
+	if _, cancelled := gf.counts(); cancelled != 1 {
+		t.Errorf("%d fetches cancelled, want 1", cancelled)
+	}
+}
+
+// dataFetcher serves ranges of data, which may be replaced.
+type dataFetcher struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (df *dataFetcher) FetchRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, int64, error) {
+	df.mu.Lock()
+	data := df.data
+	df.mu.Unlock()
+	end := off + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return io.NopCloser(bytes.NewReader(data[off:end])), int64(len(data)), nil
+}
+
+func (df *dataFetcher) set(data []byte) {
+	df.mu.Lock()
+	df.data = data
+	df.mu.Unlock()
+}
+
+func readAll(s *PartialStore, name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestPartialStoreEmptyObject(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "empty", time.Time{}, bytes.NewReader(nil))
+	}))
+	defer origin.Close()
+	s, err := NewPartialStore(t.TempDir(), 16, &HTTPRangeFetcher{BaseURL: origin.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	f, err := s.Open("b/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fi, _ := f.Stat(); fi.Size() != 0 {
+		t.Errorf("size %d, want 0", fi.Size())
+	}
+	if n, err := f.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Errorf("read %d, %v, want EOF", n, err)
+	}
+}
+
+func TestPartialStoreConcurrentReaders(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16)
+	s, err := NewPartialStore(t.TempDir(), 16, &dataFetcher{data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := readAll(s, "b/obj"); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, %v", len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPartialStoreOriginChanged(t *testing.T) {
+	df := &dataFetcher{data: bytes.Repeat([]byte("a"), 48)}
+	s, err := NewPartialStore(t.TempDir(), 16, df)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	old, err := s.Open("b/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if _, err := old.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	df.set(bytes.Repeat([]byte("b"), 40))
+	if _, err := old.Read(make([]byte, 16)); err != ErrOriginChanged {
+		t.Fatalf("read after the change got %v, want ErrOriginChanged", err)
+	}
+	if got, err := readAll(s, "b/obj"); err != nil || !bytes.Equal(got, df.data) {
+		t.Fatalf("reopened: %q, %v", got, err)
+	}
+	// the stale file neither reads its old chunks nor drops the new object
+	if _, err := old.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Read(make([]byte, 16)); err != ErrOriginChanged {
+		t.Errorf("stale read got %v, want ErrOriginChanged", err)
+	}
+	if present, total, ok := s.Present("b/obj"); !ok || present != total {
+		t.Errorf("present %d of %d, %v after a stale read", present, total, ok)
+	}
+}
+
+func TestPartialStoreDataFileRemoved(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3)
+	root := t.TempDir()
+	s, err := NewPartialStore(root, 16, &dataFetcher{data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := readAll(s, "b/obj"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "b", "obj")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(s, "b/obj"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q, %v after removing the data file", got, err)
+	}
+
+	// a new store finds only the sidecar
+	os.Remove(filepath.Join(root, "b", "obj"))
+	s2, err := NewPartialStore(root, 16, &dataFetcher{data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if got, err := readAll(s2, "b/obj"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q, %v with only the sidecar", got, err)
+	}
+}
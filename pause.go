@@ -0,0 +1,122 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pauseController lets in-flight transfers block while the server is paused.
+// All waiters are released at once when the pause expires or is cancelled.
+type pauseController struct {
+	mu    sync.Mutex
+	until time.Time
+	timer *time.Timer
+	gen   uint64
+	// resumed is closed whenever the server is not paused.
+	resumed chan struct{}
+	// moment mirrors until as Unix seconds, 0 when not paused.
+	moment *int64
+}
+
+func newPauseController(moment *int64) *pauseController {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &pauseController{resumed: resumed, moment: moment}
+}
+
+// setUntil must be called with p.mu held.
+func (p *pauseController) setUntil(until time.Time) {
+	p.until = until
+	if p.moment != nil {
+		*p.moment = 0
+		if !until.IsZero() {
+			*p.moment = until.Unix()
+		}
+	}
+}
+
+// pause blocks transfers for d from now. A later call replaces the deadline
+// of an earlier one, so a pause can be extended or shortened. d <= 0 resumes.
+func (p *pauseController) pause(d time.Duration) {
+	if d <= 0 {
+		p.resume()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setUntil(time.Now().Add(d))
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	select {
+	case <-p.resumed:
+		p.resumed = make(chan struct{})
+	default:
+	}
+	p.gen++
+	gen := p.gen
+	p.timer = time.AfterFunc(d, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// a newer pause or resume call owns the state now
+		if p.gen != gen {
+			return
+		}
+		p.release()
+	})
+}
+
+// resume ends the current pause early.
+func (p *pauseController) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.release()
+}
+
+// release must be called with p.mu held.
+func (p *pauseController) release() {
+	p.gen++
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.setUntil(time.Time{})
+	select {
+	case <-p.resumed:
+	default:
+		close(p.resumed)
+	}
+}
+
+// done returns a channel that is closed once the server is not paused.
+func (p *pauseController) done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
+
+// wait blocks until the server is not paused or ctx is done, and returns
+// how long it blocked.
+func (p *pauseController) wait(ctx context.Context) (time.Duration, error) {
+	done := p.done()
+	select {
+	case <-done:
+		return 0, nil
+	default:
+	}
+	start := time.Now()
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
+
+func (p *pauseController) pausedUntil() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.until
+}
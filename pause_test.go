@@ -0,0 +1,23 @@
+package MesonTerminalEchoServer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseMomentKeptInSync(t *testing.T) {
+	hs := New()
+	hs.SetPauseSeconds(60)
+	if want := hs.GetPauseUntil().Unix(); hs.PauseMoment != want || hs.GetPauseMoment() != want {
+		t.Errorf("PauseMoment %d, want %d", hs.PauseMoment, want)
+	}
+	hs.Resume()
+	if hs.PauseMoment != 0 {
+		t.Errorf("PauseMoment %d after Resume, want 0", hs.PauseMoment)
+	}
+	hs.SetPauseDuration(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if hs.GetPauseMoment() != 0 {
+		t.Errorf("GetPauseMoment %d after the pause ended, want 0", hs.GetPauseMoment())
+	}
+}
@@ -0,0 +1,258 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A RateLimiter is a token bucket measured in bytes. It refills at
+// bytesPerSec and holds at most burst bytes. A RateLimiter with a
+// non-positive rate is unlimited.
+//
+// The limit can be changed at any time with SetLimit; transfers that are
+// waiting for tokens pick up the new limit immediately.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSec bytes per second
+// with bursts of up to burst bytes. If burst <= 0 it defaults to one second
+// worth of traffic.
+func NewRateLimiter(bytesPerSec, burst int64) *RateLimiter {
+	l := &RateLimiter{changed: make(chan struct{})}
+	l.setLimit(bytesPerSec, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// SetLimit changes the rate and burst of l. bytesPerSec <= 0 removes the limit.
+func (l *RateLimiter) SetLimit(bytesPerSec, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	wasUnlimited := l.rate <= 0
+	l.setLimit(bytesPerSec, burst)
+	if wasUnlimited || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Limit returns the current rate and burst of l.
+func (l *RateLimiter) Limit() (bytesPerSec, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, 0
+	}
+	return int64(l.rate), int64(l.burst)
+}
+
+// setLimit must be called with l.mu held.
+func (l *RateLimiter) setLimit(bytesPerSec, burst int64) {
+	if bytesPerSec <= 0 {
+		l.rate, l.burst = 0, 0
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	l.rate, l.burst = float64(bytesPerSec), float64(burst)
+}
+
+// advance refills the bucket up to now. It must be called with l.mu held.
+func (l *RateLimiter) advance(now time.Time) {
+	if l.rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// take blocks until it can hand out up to max bytes and returns how many
+// bytes the caller may send, which is at least 1 and at most max. Requests
+// larger than the burst are cut down to the burst. It gives up when ctx is done.
+func (l *RateLimiter) take(ctx context.Context, max int) (int, error) {
+	if max <= 0 {
+		return 0, nil
+	}
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return max, nil
+		}
+		l.advance(time.Now())
+		want := float64(max)
+		if want > l.burst {
+			want = l.burst
+		}
+		if want < 1 {
+			want = 1
+		}
+		if l.tokens >= want {
+			l.tokens -= want
+			l.mu.Unlock()
+			return int(want), nil
+		}
+		delay := time.Duration((want - l.tokens) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// refund gives back n bytes that were taken but not sent.
+func (l *RateLimiter) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// limiterChain applies several limiters to the same transfer, tightest first.
+type limiterChain []*RateLimiter
+
+// take returns how many bytes, up to max, every limiter in the chain agreed
+// to. Tokens granted by one limiter but refused by a later one are refunded.
+func (c limiterChain) take(ctx context.Context, max int) (int, error) {
+	grant := max
+	for i, l := range c {
+		n, err := l.take(ctx, grant)
+		if n < grant {
+			for _, prev := range c[:i] {
+				prev.refund(grant - n)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		grant = n
+	}
+	return grant, nil
+}
+
+func (c limiterChain) refund(n int) {
+	for _, l := range c {
+		l.refund(n)
+	}
+}
+
+// clientLimiterPool hands out one shared RateLimiter per client IP. A
+// client's limiter lives as long as it has transfers in flight.
+type clientLimiterPool struct {
+	mu      sync.Mutex
+	rate    int64
+	burst   int64
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	*RateLimiter
+	refs int
+}
+
+func newClientLimiterPool() *clientLimiterPool {
+	return &clientLimiterPool{clients: map[string]*clientLimiter{}}
+}
+
+func (p *clientLimiterPool) setLimit(bytesPerSec, burst int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate, p.burst = bytesPerSec, burst
+	for _, c := range p.clients {
+		c.SetLimit(bytesPerSec, burst)
+	}
+}
+
+func (p *clientLimiterPool) limit() (bytesPerSec, burst int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate, p.burst
+}
+
+// acquire returns the limiter for ip and a func that must be called when
+// the transfer is finished.
+func (p *clientLimiterPool) acquire(ip string) (*RateLimiter, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[ip]
+	if !ok {
+		c = &clientLimiter{RateLimiter: NewRateLimiter(p.rate, p.burst)}
+		p.clients[ip] = c
+	}
+	c.refs++
+	return c.RateLimiter, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		c.refs--
+		if c.refs == 0 {
+			delete(p.clients, ip)
+		}
+	}
+}
+
+// transferLimits returns the limiters that apply to a transfer for r,
+// tightest first, and a func that must be called when the transfer ends.
+func (hs *HttpServer) transferLimits(r *http.Request, opts *serveOptions) (limiterChain, func()) {
+	var limits limiterChain
+
+	connLimit := rateLimit{}
+	connLimit.bytesPerSec, connLimit.burst = hs.GetConnectionRateLimit()
+	if opts != nil && opts.connLimit != nil {
+		connLimit = *opts.connLimit
+	}
+	if connLimit.bytesPerSec > 0 {
+		limits = append(limits, NewRateLimiter(connLimit.bytesPerSec, connLimit.burst))
+	}
+
+	// the client limiter is taken even while unlimited so that a later
+	// SetClientIPRateLimit reaches transfers already in flight.
+	client, release := hs.clients.acquire(hs.clientIP(r))
+	limits = append(limits, client, hs.bandwidth)
+	return limits, release
+}
+
+func (hs *HttpServer) clientIP(r *http.Request) string {
+	if hs.IPExtractor != nil {
+		return hs.IPExtractor(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
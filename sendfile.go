@@ -0,0 +1,182 @@
+package MesonTerminalEchoServer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+// sendfileChunk bounds how much a single sendfile call may transfer, so the
+// pause and bandwidth checks still run regularly on the zero-copy path.
+const sendfileChunk = 512 * 1024
+
+// sendfileWriter returns the io.ReaderFrom that can move file data to the
+// client without copying it through userspace, and a func to account the
+// bytes moved that way. ok is false if dst has no such fast path.
+func sendfileWriter(dst io.Writer) (rf io.ReaderFrom, count func(n int64), ok bool) {
+	if !sendfileSupported {
+		return nil, nil, false
+	}
+	w, count, ok := responseWriter(dst)
+	if !ok {
+		return nil, nil, false
+	}
+	rf, ok = w.(io.ReaderFrom)
+	return rf, count, ok
+}
+
+// responseWriter returns the http.ResponseWriter below dst and a func to
+// account the bytes written past echo.
+func responseWriter(dst io.Writer) (w http.ResponseWriter, count func(n int64), ok bool) {
+	switch d := dst.(type) {
+	case *echo.Response:
+		// write below echo so the copy reaches the connection's ReadFrom,
+		// but keep echo's size accounting right.
+		return d.Writer, func(n int64) { d.Size += n }, true
+	case http.ResponseWriter:
+		return d, func(int64) {}, true
+	}
+	return nil, nil, false
+}
+
+var errSendfileAt = errors.New("sendfile at an offset is not supported")
+
+// connContextKey is the request context key of the client connection, set
+// by the servers of an HttpServer.
+type connContextKey struct{}
+
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// A sharedFile reads an *os.File shared with other readers at its own
+// offset, like the readers of the fd cache.
+type sharedFile interface {
+	io.Seeker
+	sharedFile() (f *os.File, off int64)
+}
+
+// sendfileConn returns the client connection of r if the body of w, read
+// from content, can be sent with sendfile at an explicit offset: content is
+// a sharedFile and the response is plain HTTP/1 with a known length on a
+// connection of the HttpServer. Since net/http doesn't know about the bytes
+// sent that way, it closes the connection after the response; sendfileConn
+// sets Connection: close to announce it, so it must be called before the
+// header is written.
+func sendfileConn(w http.ResponseWriter, r *http.Request, content io.Reader) syscall.RawConn {
+	if !sendfileSupported || r.Method == http.MethodHead || r.ProtoMajor != 1 {
+		return nil
+	}
+	if _, ok := content.(sharedFile); !ok {
+		return nil
+	}
+	h := w.Header()
+	if h.Get("Content-Length") == "" || h.Get("Transfer-Encoding") != "" {
+		return nil
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		return nil
+	}
+	c, ok := r.Context().Value(connContextKey{}).(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	h.Set("Connection", "close")
+	return rc
+}
+
+// sendFileAt copies n bytes of the shared file src to the connection conn
+// from src's own offset, in chunks of at most sendfileChunk, waiting for the
+// pause and the bandwidth limits before every chunk. The file offset of the
+// shared *os.File isn't used or moved.
+func (cp *copier) sendFileAt(conn syscall.RawConn, dst io.Writer, src sharedFile, n int64) (written int64, err error) {
+	w, count, ok := responseWriter(dst)
+	if !ok {
+		return 0, errSendfileAt
+	}
+	// the header must be on the wire before the body goes below net/http
+	w.(http.Flusher).Flush()
+	f, off := src.sharedFile()
+	defer func() { src.Seek(written, io.SeekCurrent) }()
+	for written < n {
+		paused, er := cp.hs.pause.wait(cp.ctx)
+		cp.paused += paused
+		if er != nil {
+			return written, cp.abortErr(er)
+		}
+		chunk := n - written
+		if chunk > sendfileChunk {
+			chunk = sendfileChunk
+		}
+		grant, er := cp.limits.take(cp.ctx, int(chunk))
+		if er != nil {
+			return written, cp.abortErr(er)
+		}
+
+		nw, ew := sendfileAt(conn, f, off+written, grant)
+		cp.limits.refund(grant - nw)
+		if nw > 0 {
+			written += int64(nw)
+			count(int64(nw))
+			if cp.progress != nil {
+				cp.progress(written)
+			}
+		}
+		if ew != nil {
+			return written, ew
+		}
+		if nw < grant {
+			// src stopped early; must have been EOF.
+			return written, io.EOF
+		}
+	}
+	return written, nil
+}
+
+// sendFile copies n bytes from f to rf in chunks of at most sendfileChunk,
+// waiting for the pause and the bandwidth limits before every chunk.
+func (cp *copier) sendFile(rf io.ReaderFrom, count func(n int64), f *os.File, n int64) (written int64, err error) {
+	for written < n {
+		paused, er := cp.hs.pause.wait(cp.ctx)
+		cp.paused += paused
+		if er != nil {
+			return written, cp.abortErr(er)
+		}
+		chunk := n - written
+		if chunk > sendfileChunk {
+			chunk = sendfileChunk
+		}
+		grant, er := cp.limits.take(cp.ctx, int(chunk))
+		if er != nil {
+			return written, cp.abortErr(er)
+		}
+
+		nw, ew := rf.ReadFrom(io.LimitReader(f, int64(grant)))
+		cp.limits.refund(grant - int(nw))
+		if nw > 0 {
+			written += nw
+			count(nw)
+			if cp.progress != nil {
+				cp.progress(written)
+			}
+		}
+		if ew != nil {
+			return written, ew
+		}
+		if nw < int64(grant) {
+			// f stopped early; must have been EOF.
+			return written, io.EOF
+		}
+	}
+	return written, nil
+}
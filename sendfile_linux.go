@@ -0,0 +1,44 @@
+package MesonTerminalEchoServer
+
+import (
+	"os"
+	"syscall"
+)
+
+// On Linux the net package turns ReadFrom of a *os.File into sendfile(2).
+const sendfileSupported = true
+
+// sendfileAt sends up to n bytes of src from off to the connection conn
+// with one sendfile(2) call, waiting while conn can't take more. Unlike the
+// ReadFrom path it neither uses nor moves src's file offset.
+func sendfileAt(conn syscall.RawConn, src *os.File, off int64, n int) (written int, err error) {
+	sc, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var werr, serr error
+	err = sc.Control(func(sfd uintptr) {
+		werr = conn.Write(func(dfd uintptr) bool {
+			for {
+				written, serr = syscall.Sendfile(int(dfd), int(sfd), &off, n)
+				if serr != syscall.EINTR {
+					break
+				}
+			}
+			if written < 0 {
+				written = 0
+			}
+			// wait for conn to be writable again
+			return serr != syscall.EAGAIN
+		})
+	})
+	switch {
+	case err != nil:
+		return 0, err
+	case werr != nil:
+		return written, werr
+	case serr != nil:
+		return written, os.NewSyscallError("sendfile", serr)
+	}
+	return written, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package MesonTerminalEchoServer
+
+import (
+	"os"
+	"syscall"
+)
+
+const sendfileSupported = false
+
+func sendfileAt(conn syscall.RawConn, src *os.File, off int64, n int) (int, error) {
+	return 0, errSendfileAt
+}
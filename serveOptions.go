@@ -0,0 +1,99 @@
+package MesonTerminalEchoServer
+
+// A ServeOption overrides the server defaults for a single FileWithPause call.
+type ServeOption func(*serveOptions)
+
+type serveOptions struct {
+	connLimit *rateLimit
+
+	sidecarPath string
+	sidecarOpts HeaderParseOptions
+	// sidecar is loaded by FileWithPause from sidecarPath.
+	sidecar *Sidecar
+	// digest is set by FileWithPause from the hash store.
+	digest *DigestRecord
+	// encoding is the content coding of a precompressed variant served
+	// instead of the file.
+	encoding string
+	// compress is the content coding to compress the body with while it
+	// is sent.
+	compress string
+	// persistPath is the file whose variant for compress is stored once
+	// the response went out, or "".
+	persistPath string
+
+	bindName    string
+	headerRules *HeaderRuleSet
+	originPath  string
+	origin      *OriginConfig
+}
+
+type rateLimit struct {
+	bytesPerSec int64
+	burst       int64
+}
+
+func newServeOptions(opts []ServeOption) *serveOptions {
+	o := &serveOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithConnectionRateLimit replaces the server's per-connection rate limit
+// for this transfer. bytesPerSec <= 0 lifts the per-connection limit; the
+// per-IP and global limits still apply.
+func WithConnectionRateLimit(bytesPerSec, burst int64) ServeOption {
+	return func(o *serveOptions) {
+		o.connLimit = &rateLimit{bytesPerSec, burst}
+	}
+}
+
+// WithSidecar makes FileWithPause read the sidecar at path, in any of the
+// sidecar formats, and add its header to the response like the header
+// argument. A missing sidecar is not an error; a malformed one is handled
+// as opts says and its header entries are dropped in the strict mode.
+func WithSidecar(path string, opts HeaderParseOptions) ServeOption {
+	return func(o *serveOptions) {
+		o.sidecarPath = path
+		o.sidecarOpts = opts
+	}
+}
+
+// WithBindName tells FileWithPause which bindname the file belongs to, for
+// matching header rules and expanding ${bindname}.
+func WithBindName(bindName string) ServeOption {
+	return func(o *serveOptions) {
+		o.bindName = bindName
+	}
+}
+
+// WithHeaderRules replaces the header rules of the server for this call.
+// A nil rs applies no rules.
+func WithHeaderRules(rs *HeaderRuleSet) ServeOption {
+	return func(o *serveOptions) {
+		o.headerRules = rs
+	}
+}
+
+// WithOriginPath gives the path of the file at the origin of its bindname.
+// If the file is missing and an origin is set for the bindname given with
+// WithBindName, FileWithPause fetches it from there, stores it and serves
+// it while it arrives.
+func WithOriginPath(p string) ServeOption {
+	return func(o *serveOptions) {
+		o.originPath = p
+	}
+}
+
+// WithOrigin fetches a missing file from cfg rather than from the origin
+// set for its bindname. It takes effect together with WithOriginPath.
+func WithOrigin(cfg *OriginConfig) ServeOption {
+	if cfg != nil {
+		cfg = cfg.normalized()
+	}
+	return func(o *serveOptions) {
+		o.origin = cfg
+	}
+}
@@ -0,0 +1,335 @@
+package MesonTerminalEchoServer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// SidecarVersion is the version written by the JSON and binary sidecar
+// encodings.
+const SidecarVersion = 1
+
+// A SidecarFormat is an encoding of the metadata stored next to a cached file.
+type SidecarFormat int
+
+const (
+	// SidecarLegacy is the line format of the original .header files. It
+	// only stores the header.
+	SidecarLegacy SidecarFormat = iota
+	SidecarJSON
+	SidecarBinary
+)
+
+func (f SidecarFormat) String() string {
+	switch f {
+	case SidecarLegacy:
+		return "legacy"
+	case SidecarJSON:
+		return "json"
+	case SidecarBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("SidecarFormat(%d)", int(f))
+}
+
+// sidecarMagic starts every binary sidecar. It can't start a legacy file
+// since it is not a valid header name.
+var sidecarMagic = []byte("\x00MSC")
+
+// A Sidecar is the metadata stored next to a cached file.
+type Sidecar struct {
+	// Version is 0 for sidecars read from the legacy format.
+	Version int                 `json:"version"`
+	Header  map[string][]string `json:"header,omitempty"`
+	// OriginURL is where the file was fetched from.
+	OriginURL string `json:"origin_url,omitempty"`
+	// FetchedAt is when the file was fetched, or nil if unknown.
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	// ContentHash is the hash of the file as "algorithm:hex",
+	// for example "sha256:9f86d0...".
+	ContentHash string `json:"content_hash,omitempty"`
+	// Size is the size of the file, or -1 if unknown.
+	Size int64 `json:"size"`
+	// Status is the status code the origin answered with.
+	Status int `json:"status,omitempty"`
+}
+
+// ReadSidecar reads the sidecar at filePath in any of the sidecar formats.
+func ReadSidecar(filePath string) (*Sidecar, error) {
+	return ReadSidecarWithOptions(filePath, HeaderParseOptions{})
+}
+
+// ReadSidecarWithOptions reads the sidecar at filePath in any of the sidecar
+// formats. The header it stores is checked like ReadHeaderFileWithOptions does.
+func ReadSidecarWithOptions(filePath string, opts HeaderParseOptions) (*Sidecar, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc, _, err := ParseSidecar(f, opts)
+	if e, ok := err.(*HeaderFileError); ok {
+		e.Path = filePath
+	}
+	return sc, err
+}
+
+// ParseSidecar detects the format of the sidecar in r and parses it. With
+// opts.BestEffort it may return both a sidecar and an error.
+func ParseSidecar(r io.Reader, opts HeaderParseOptions) (*Sidecar, SidecarFormat, error) {
+	opts = opts.withDefaults()
+	buf := bufio.NewReader(io.LimitReader(r, opts.MaxSize+1))
+	format := detectSidecarFormat(buf)
+
+	if format == SidecarLegacy {
+		header, err := ParseHeader(buf, opts)
+		if header == nil {
+			return nil, format, err
+		}
+		return &Sidecar{Header: header, Size: -1}, format, err
+	}
+
+	data, err := io.ReadAll(buf)
+	if err != nil {
+		return nil, format, err
+	}
+	if int64(len(data)) > opts.MaxSize {
+		return nil, format, &HeaderFileError{Msg: fmt.Sprintf("sidecar larger than %d bytes", opts.MaxSize)}
+	}
+	sc := &Sidecar{Size: -1}
+	if format == SidecarJSON {
+		err = json.Unmarshal(bytes.TrimPrefix(data, utf8BOM), sc)
+	} else {
+		err = sc.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return nil, format, &HeaderFileError{Msg: err.Error()}
+	}
+	if sc.Version < 1 || sc.Version > SidecarVersion {
+		return nil, format, &HeaderFileError{Msg: fmt.Sprintf("unsupported sidecar version %d", sc.Version)}
+	}
+	err = sc.checkHeader(opts)
+	if err != nil && !opts.BestEffort {
+		return nil, format, err
+	}
+	return sc, format, err
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// detectSidecarFormat returns the format of the sidecar buffered in buf
+// without consuming it. JSON may start with a byte order mark and white
+// space.
+func detectSidecarFormat(buf *bufio.Reader) SidecarFormat {
+	peek, _ := buf.Peek(buf.Size())
+	if bytes.HasPrefix(peek, sidecarMagic) {
+		return SidecarBinary
+	}
+	peek = bytes.TrimLeft(bytes.TrimPrefix(peek, utf8BOM), " \t\r\n")
+	if len(peek) > 0 && peek[0] == '{' {
+		return SidecarJSON
+	}
+	return SidecarLegacy
+}
+
+// checkHeader applies the checks of ParseHeader to sc.Header. Invalid
+// entries are removed.
+func (sc *Sidecar) checkHeader(opts HeaderParseOptions) error {
+	var firstErr error
+	keys := make([]string, 0, len(sc.Header))
+	for k := range sc.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		var err error
+		switch {
+		case i >= opts.MaxKeys:
+			err = &HeaderFileError{Msg: fmt.Sprintf("more than %d header keys", opts.MaxKeys)}
+		case !httpguts.ValidHeaderFieldName(k):
+			err = &HeaderFileError{Msg: fmt.Sprintf("invalid header name %q", k)}
+		case len(sc.Header[k]) > opts.MaxValues:
+			err = &HeaderFileError{Msg: fmt.Sprintf("header %q: more than %d values", k, opts.MaxValues)}
+		default:
+			for _, v := range sc.Header[k] {
+				if !httpguts.ValidHeaderFieldValue(v) {
+					err = &HeaderFileError{Msg: fmt.Sprintf("header %q: invalid value %q", k, v)}
+					break
+				}
+			}
+		}
+		if err != nil {
+			delete(sc.Header, k)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// WriteSidecar atomically writes sc to filePath in the given format. The
+// legacy format only keeps sc.Header. Version is set to SidecarVersion for
+// the other formats.
+func WriteSidecar(filePath string, sc *Sidecar, format SidecarFormat) error {
+	var data []byte
+	var err error
+	switch format {
+	case SidecarLegacy:
+		return WriteHeaderFile(filePath, sc.Header)
+	case SidecarJSON:
+		c := *sc
+		c.Version = SidecarVersion
+		data, err = json.MarshalIndent(&c, "", "\t")
+	case SidecarBinary:
+		data, err = sc.MarshalBinary()
+	default:
+		err = fmt.Errorf("unknown sidecar format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+// MarshalBinary encodes sc in the compact binary sidecar format:
+// the magic, then uvarint version, origin URL, fetched-at in Unix
+// nanoseconds (0 if unknown), content hash, size, status and the header as
+// a key count followed by each key with its value count and values. Strings
+// are a uvarint length followed by the bytes; keys are sorted.
+func (sc *Sidecar) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(sidecarMagic)
+	putUvarint(&b, SidecarVersion)
+	putString(&b, sc.OriginURL)
+	var fetchedAt int64
+	if sc.FetchedAt != nil && !sc.FetchedAt.IsZero() {
+		fetchedAt = sc.FetchedAt.UnixNano()
+	}
+	putVarint(&b, fetchedAt)
+	putString(&b, sc.ContentHash)
+	putVarint(&b, sc.Size)
+	putVarint(&b, int64(sc.Status))
+
+	keys := make([]string, 0, len(sc.Header))
+	for k := range sc.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	putUvarint(&b, uint64(len(keys)))
+	for _, k := range keys {
+		putString(&b, k)
+		putUvarint(&b, uint64(len(sc.Header[k])))
+		for _, v := range sc.Header[k] {
+			putString(&b, v)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+var errBadSidecar = errors.New("malformed binary sidecar")
+
+// UnmarshalBinary decodes the format written by MarshalBinary.
+func (sc *Sidecar) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, sidecarMagic) {
+		return errBadSidecar
+	}
+	r := bytes.NewReader(data[len(sidecarMagic):])
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errBadSidecar
+	}
+	if version < 1 || version > SidecarVersion {
+		return fmt.Errorf("unsupported sidecar version %d", version)
+	}
+	var s Sidecar
+	s.Version = int(version)
+	var fetchedAt, status int64
+	if s.OriginURL, err = getString(r); err != nil {
+		return err
+	}
+	if fetchedAt, err = binary.ReadVarint(r); err != nil {
+		return errBadSidecar
+	}
+	if fetchedAt != 0 {
+		t := time.Unix(0, fetchedAt).UTC()
+		s.FetchedAt = &t
+	}
+	if s.ContentHash, err = getString(r); err != nil {
+		return err
+	}
+	if s.Size, err = binary.ReadVarint(r); err != nil {
+		return errBadSidecar
+	}
+	if status, err = binary.ReadVarint(r); err != nil {
+		return errBadSidecar
+	}
+	s.Status = int(status)
+
+	keys, err := binary.ReadUvarint(r)
+	if err != nil || keys > uint64(r.Len()) {
+		return errBadSidecar
+	}
+	if keys > 0 {
+		s.Header = make(map[string][]string, keys)
+	}
+	for i := uint64(0); i < keys; i++ {
+		k, err := getString(r)
+		if err != nil {
+			return err
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return errBadSidecar
+		}
+		values := make([]string, 0, n)
+		for j := uint64(0); j < n; j++ {
+			v, err := getString(r)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		s.Header[k] = values
+	}
+	if r.Len() != 0 {
+		return errBadSidecar
+	}
+	*sc = s
+	return nil
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func putVarint(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func putString(b *bytes.Buffer, s string) {
+	putUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func getString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return "", errBadSidecar
+	}
+	buf := make([]byte, n)
+	io.ReadFull(r, buf)
+	return string(buf), nil
+}
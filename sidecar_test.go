@@ -0,0 +1,115 @@
+package MesonTerminalEchoServer
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSidecarRoundTrip(t *testing.T) {
+	fetchedAt := time.Date(2021, 9, 13, 18, 0, 0, 123456789, time.UTC)
+	sc := &Sidecar{
+		Header: map[string][]string{
+			"Content-Type":  {"video/mp4"},
+			"Cache-Control": {"public", "max-age=60"},
+		},
+		OriginURL:   "https://origin.example.com/b/movie.mp4",
+		FetchedAt:   &fetchedAt,
+		ContentHash: "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Size:        1 << 20,
+		Status:      200,
+	}
+	dir := t.TempDir()
+	for _, format := range []SidecarFormat{SidecarJSON, SidecarBinary} {
+		path := filepath.Join(dir, "movie.mp4."+format.String())
+		if err := WriteSidecar(path, sc, format); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, gotFormat, err := ParseSidecar(f, HeaderParseOptions{})
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if gotFormat != format {
+			t.Errorf("detected %v, want %v", gotFormat, format)
+		}
+		want := *sc
+		want.Version = SidecarVersion
+		if got.FetchedAt == nil || !got.FetchedAt.Equal(fetchedAt) {
+			t.Errorf("%v: fetched at %v, want %v", format, got.FetchedAt, fetchedAt)
+		}
+		got.FetchedAt = want.FetchedAt
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%v: read %+v, want %+v", format, *got, want)
+		}
+	}
+}
+
+func TestParseSidecarJSONDefaults(t *testing.T) {
+	tests := []string{
+		`{"version":1,"header":{"X-Test":["1"]}}`,
+		"\xef\xbb\xbf{\"version\":1,\"header\":{\"X-Test\":[\"1\"]}}",
+		"\n\n  \t\r\n    {\"version\":1,\"header\":{\"X-Test\":[\"1\"]}}",
+	}
+	for _, data := range tests {
+		sc, format, err := ParseSidecar(bytes.NewReader([]byte(data)), HeaderParseOptions{})
+		if err != nil || format != SidecarJSON {
+			t.Errorf("%q: %v, %v", data, format, err)
+			continue
+		}
+		if sc.Size != -1 || sc.FetchedAt != nil || sc.Header["X-Test"][0] != "1" {
+			t.Errorf("%q: read %+v", data, sc)
+		}
+	}
+
+	data, err := json.Marshal(&Sidecar{Version: SidecarVersion, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("fetched_at")) {
+		t.Errorf("unknown fetch time written: %s", data)
+	}
+}
+
+func TestSidecarLegacyHeaderOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.header")
+	sc := &Sidecar{Header: map[string][]string{"Content-Type": {"text/plain"}}, OriginURL: "http://o/a", Size: 3}
+	if err := WriteSidecar(path, sc, SidecarLegacy); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSidecar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Sidecar{Header: sc.Header, Size: -1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+}
+
+func TestParseSidecarRejectsInvalidHeader(t *testing.T) {
+	for _, data := range []string{
+		`{"version":1,"header":{"Bad Name":["v"]},"size":1}`,
+		`{"version":1,"header":{"X-Ok":["a\nb"]},"size":1}`,
+		`{"version":99,"size":1}`,
+	} {
+		if _, _, err := ParseSidecar(bytes.NewReader([]byte(data)), HeaderParseOptions{}); err == nil {
+			t.Errorf("%s: parsed without error", data)
+		}
+	}
+	bin, err := (&Sidecar{Header: map[string][]string{"Bad Name": {"v"}}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseSidecar(bytes.NewReader(bin), HeaderParseOptions{}); err == nil {
+		t.Error("binary sidecar with invalid name parsed without error")
+	}
+}
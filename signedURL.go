@@ -0,0 +1,337 @@
+package MesonTerminalEchoServer
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The query parameters of a signed URL. Other parameters of the URL are not
+// covered by the signature.
+const (
+	SignKeyIDParam   = "kid"
+	SignExpiresParam = "expires"
+	SignIPParam      = "ip"
+	SignPrefixParam  = "prefix"
+	SignatureParam   = "sig"
+)
+
+// MinHMACSecretSize is the shortest HMAC secret accepted, in bytes.
+const MinHMACSecretSize = 16
+
+var (
+	// ErrURLNotSigned is returned for URLs without a signature.
+	ErrURLNotSigned = errors.New("url is not signed")
+	// ErrURLExpired is returned for signed URLs past their expiry.
+	ErrURLExpired = errors.New("signed url expired")
+	// ErrURLSignature is returned for signatures that don't verify, or
+	// that were made with an unknown key.
+	ErrURLSignature = errors.New("invalid url signature")
+	// ErrURLScope is returned for signed URLs used from a client address
+	// or for a path they don't allow, including paths that aren't in their
+	// canonical form.
+	ErrURLScope = errors.New("signed url not valid for this request")
+)
+
+func checkHMACSecret(secret []byte) error {
+	if len(secret) < MinHMACSecretSize {
+		return fmt.Errorf("hmac secret of %d bytes, at least %d required", len(secret), MinHMACSecretSize)
+	}
+	return nil
+}
+
+// checkKeyID rejects key IDs that could shift the fields of the signed
+// message, which are separated by newlines.
+func checkKeyID(keyID string) error {
+	if strings.Contains(keyID, "\n") {
+		return fmt.Errorf("key id %q contains a newline", keyID)
+	}
+	return nil
+}
+
+func checkEd25519Key(size, want int) error {
+	if size != want {
+		return fmt.Errorf("ed25519 key of %d bytes, want %d", size, want)
+	}
+	return nil
+}
+
+// SignOptions restrict what a signed URL may be used for.
+type SignOptions struct {
+	// Expires is when the URL stops being valid. Required.
+	Expires time.Time
+	// ClientIP limits the URL to a client address, given as an IP or a
+	// CIDR prefix like 203.0.113.0/24.
+	ClientIP string
+	// PathPrefix makes the URL's signature valid for every path under the
+	// prefix, so one signature covers a whole directory. Otherwise it is
+	// valid for the URL's path only.
+	PathPrefix string
+}
+
+// A URLSigner mints URLs that a URLVerifier holding its key accepts.
+type URLSigner struct {
+	keyID string
+	sign  func(msg []byte) []byte
+}
+
+// NewHMACSigner returns a signer using HMAC-SHA256 with secret, known to
+// verifiers as keyID. secret must be at least MinHMACSecretSize bytes.
+func NewHMACSigner(keyID string, secret []byte) (*URLSigner, error) {
+	if err := checkKeyID(keyID); err != nil {
+		return nil, err
+	}
+	if err := checkHMACSecret(secret); err != nil {
+		return nil, err
+	}
+	secret = append([]byte(nil), secret...)
+	return &URLSigner{keyID: keyID, sign: func(msg []byte) []byte { return hmacSum(secret, msg) }}, nil
+}
+
+// NewEd25519Signer returns a signer using Ed25519 with key, known to
+// verifiers as keyID.
+func NewEd25519Signer(keyID string, key ed25519.PrivateKey) (*URLSigner, error) {
+	if err := checkKeyID(keyID); err != nil {
+		return nil, err
+	}
+	if err := checkEd25519Key(len(key), ed25519.PrivateKeySize); err != nil {
+		return nil, err
+	}
+	key = append(ed25519.PrivateKey(nil), key...)
+	return &URLSigner{keyID: keyID, sign: func(msg []byte) []byte { return ed25519.Sign(key, msg) }}, nil
+}
+
+// Sign returns rawURL with the signature parameters added. rawURL may be a
+// path or an absolute URL; its existing query is kept. Its path must be
+// canonical, without dot segments or repeated slashes, since verifiers
+// reject other paths.
+func (s *URLSigner) Sign(rawURL string, opts SignOptions) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if opts.Expires.IsZero() {
+		return "", errors.New("sign url: no expiry")
+	}
+	if opts.ClientIP != "" && parseIPScope(opts.ClientIP) == nil {
+		return "", fmt.Errorf("sign url: invalid client ip %q", opts.ClientIP)
+	}
+	p := u.Path
+	if cleanURLPath(p) != p {
+		return "", fmt.Errorf("sign url: path %q is not canonical", p)
+	}
+	prefix := ""
+	if opts.PathPrefix != "" {
+		prefix = cleanURLPath(opts.PathPrefix)
+		if !hasPathPrefix(p, prefix) {
+			return "", fmt.Errorf("sign url: %s is not under %s", p, prefix)
+		}
+	}
+	expires := strconv.FormatInt(opts.Expires.Unix(), 10)
+
+	q := u.Query()
+	for _, k := range []string{SignKeyIDParam, SignExpiresParam, SignIPParam, SignPrefixParam, SignatureParam} {
+		q.Del(k)
+	}
+	q.Set(SignKeyIDParam, s.keyID)
+	q.Set(SignExpiresParam, expires)
+	if opts.ClientIP != "" {
+		q.Set(SignIPParam, opts.ClientIP)
+	}
+	if prefix != "" {
+		q.Set(SignPrefixParam, prefix)
+	}
+	msg := signedMessage(s.keyID, expires, opts.ClientIP, prefix, p)
+	q.Set(SignatureParam, base64.RawURLEncoding.EncodeToString(s.sign(msg)))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// signedMessage is what a signature covers: the key, expiry and client
+// scope, and either the path prefix or the exact path.
+func signedMessage(keyID, expires, ip, prefix, p string) []byte {
+	target := "path:" + p
+	if prefix != "" {
+		target = "prefix:" + prefix
+	}
+	return []byte(strings.Join([]string{"v1", keyID, expires, ip, target}, "\n"))
+}
+
+func hmacSum(secret, msg []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// cleanURLPath returns p rooted and without dot segments, keeping a trailing
+// slash.
+func cleanURLPath(p string) string {
+	cp := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cp != "/" {
+		cp += "/"
+	}
+	return cp
+}
+
+// hasPathPrefix reports whether p is prefix or below it.
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func parseIPScope(s string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// A URLVerifier checks the URLs minted by URLSigners. It holds the keys by
+// ID, so keys can be rotated by adding the new one, switching the signers
+// over and removing the old one once its URLs expired.
+type URLVerifier struct {
+	mu   sync.RWMutex
+	keys map[string]func(msg, sig []byte) bool
+	// skew is the clock difference to the signers tolerated on expiry.
+	skew time.Duration
+}
+
+// NewURLVerifier returns a verifier without keys, accepting URLs up to skew
+// past their expiry.
+func NewURLVerifier(skew time.Duration) *URLVerifier {
+	return &URLVerifier{keys: map[string]func(msg, sig []byte) bool{}, skew: skew}
+}
+
+// AddHMACKey accepts the URLs signed by NewHMACSigner(keyID, secret).
+// secret must be at least MinHMACSecretSize bytes.
+func (v *URLVerifier) AddHMACKey(keyID string, secret []byte) error {
+	if err := checkKeyID(keyID); err != nil {
+		return err
+	}
+	if err := checkHMACSecret(secret); err != nil {
+		return err
+	}
+	secret = append([]byte(nil), secret...)
+	v.setKey(keyID, func(msg, sig []byte) bool { return hmac.Equal(hmacSum(secret, msg), sig) })
+	return nil
+}
+
+// AddEd25519Key accepts the URLs signed by the private key of key under
+// keyID.
+func (v *URLVerifier) AddEd25519Key(keyID string, key ed25519.PublicKey) error {
+	if err := checkKeyID(keyID); err != nil {
+		return err
+	}
+	if err := checkEd25519Key(len(key), ed25519.PublicKeySize); err != nil {
+		return err
+	}
+	key = append(ed25519.PublicKey(nil), key...)
+	v.setKey(keyID, func(msg, sig []byte) bool { return ed25519.Verify(key, msg, sig) })
+	return nil
+}
+
+// RemoveKey stops accepting the URLs signed with keyID.
+func (v *URLVerifier) RemoveKey(keyID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.keys, keyID)
+}
+
+func (v *URLVerifier) setKey(keyID string, verify func(msg, sig []byte) bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[keyID] = verify
+}
+
+// Verify checks the signature of r's URL, and that it is valid now, for
+// r's path and for a client at clientIP. Paths with dot segments or
+// repeated slashes are rejected rather than cleaned, since the handler
+// might resolve them differently.
+func (v *URLVerifier) Verify(r *http.Request, clientIP string) error {
+	q := r.URL.Query()
+	if q.Get(SignatureParam) == "" {
+		return ErrURLNotSigned
+	}
+	if cleanURLPath(r.URL.Path) != r.URL.Path {
+		return ErrURLScope
+	}
+	return v.verify(q, r.URL.Path, clientIP)
+}
+
+// verify checks the signature parameters in q for the canonical path p.
+func (v *URLVerifier) verify(q url.Values, p, clientIP string) error {
+	sig := q.Get(SignatureParam)
+	if sig == "" {
+		return ErrURLNotSigned
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrURLSignature
+	}
+	keyID, expires := q.Get(SignKeyIDParam), q.Get(SignExpiresParam)
+	ip, prefix := q.Get(SignIPParam), q.Get(SignPrefixParam)
+	if strings.Contains(keyID+expires+ip+prefix, "\n") {
+		// the fields of the signed message would be ambiguous
+		return ErrURLSignature
+	}
+
+	v.mu.RLock()
+	verify, ok := v.keys[keyID]
+	v.mu.RUnlock()
+	if !ok || !verify(signedMessage(keyID, expires, ip, prefix, p), rawSig) {
+		return ErrURLSignature
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrURLSignature
+	}
+	if time.Now().After(time.Unix(exp, 0).Add(v.skew)) {
+		return ErrURLExpired
+	}
+	if prefix != "" && !hasPathPrefix(p, prefix) {
+		return ErrURLScope
+	}
+	if ip != "" {
+		n := parseIPScope(ip)
+		if n == nil || !n.Contains(net.ParseIP(clientIP)) {
+			return ErrURLScope
+		}
+	}
+	return nil
+}
+
+// SignedURLMiddleware rejects requests whose URL doesn't carry a valid
+// signature from v with 403. The client address is taken as for the per-IP
+// rate limit, so set IPExtractor when running behind a proxy.
+func (hs *HttpServer) SignedURLMiddleware(v *URLVerifier) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := v.Verify(c.Request(), hs.clientIP(c.Request())); err != nil {
+				return echo.NewHTTPError(http.StatusForbidden, err.Error())
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package MesonTerminalEchoServer
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var testHMACSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestSigners(t *testing.T) (*URLVerifier, *URLSigner, *URLSigner) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewURLVerifier(0)
+	if err := v.AddHMACKey("h1", testHMACSecret); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddEd25519Key("e1", pub); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := NewHMACSigner("h1", testHMACSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := NewEd25519Signer("e1", priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, hs, es
+}
+
+func mustSign(t *testing.T, s *URLSigner, rawURL string, opts SignOptions) string {
+	t.Helper()
+	u, err := s.Sign(rawURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// withPath returns the signed URL u with its path replaced by p.
+func withPath(u, p string) string {
+	return p + u[strings.IndexByte(u, '?'):]
+}
+
+func TestSignedURLVerify(t *testing.T) {
+	v, hs, es := newTestSigners(t)
+	exp := time.Now().Add(time.Minute)
+	exact := mustSign(t, hs, "/api/cdn/b1/x.jpg?randkey=1", SignOptions{Expires: exp})
+	scoped := mustSign(t, es, "/api/cdn/b1/a/x.jpg", SignOptions{Expires: exp, ClientIP: "10.0.0.0/8", PathPrefix: "/api/cdn/b1/"})
+	expired := mustSign(t, hs, "/a", SignOptions{Expires: time.Now().Add(-time.Minute)})
+
+	tests := []struct {
+		name, url, ip string
+		want          error
+	}{
+		{"hmac", exact, "192.0.2.1", nil},
+		{"hmac other path", withPath(exact, "/api/cdn/b1/y.jpg"), "192.0.2.1", ErrURLSignature},
+		{"ed25519 prefix", scoped, "10.1.2.3", nil},
+		{"ed25519 sibling under prefix", withPath(scoped, "/api/cdn/b1/other.jpg"), "10.1.2.3", nil},
+		{"outside prefix", withPath(scoped, "/api/cdn/b2/x.jpg"), "10.1.2.3", ErrURLScope},
+		{"other client", scoped, "11.1.2.3", ErrURLScope},
+		{"no client", scoped, "", ErrURLScope},
+		{"dot segments", withPath(scoped, "/api/cdn/b1/../b2/x.jpg"), "10.1.2.3", ErrURLScope},
+		{"repeated slash", withPath(exact, "/api/cdn//b1/x.jpg"), "192.0.2.1", ErrURLScope},
+		{"expired", expired, "", ErrURLExpired},
+		{"not signed", "/api/cdn/b1/x.jpg", "", ErrURLNotSigned},
+	}
+	for _, tt := range tests {
+		if err := v.Verify(httptest.NewRequest(http.MethodGet, tt.url, nil), tt.ip); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	v.RemoveKey("h1")
+	if err := v.Verify(httptest.NewRequest(http.MethodGet, exact, nil), ""); err != ErrURLSignature {
+		t.Errorf("removed key: %v, want %v", err, ErrURLSignature)
+	}
+}
+
+func TestSignedURLRejectsWeakKeys(t *testing.T) {
+	v := NewURLVerifier(0)
+	for _, secret := range [][]byte{nil, []byte(""), []byte("short")} {
+		if err := v.AddHMACKey("k", secret); err == nil {
+			t.Errorf("AddHMACKey accepted %q", secret)
+		}
+		if _, err := NewHMACSigner("k", secret); err == nil {
+			t.Errorf("NewHMACSigner accepted %q", secret)
+		}
+	}
+	if err := v.AddEd25519Key("k", ed25519.PublicKey("short")); err == nil {
+		t.Error("AddEd25519Key accepted a short key")
+	}
+	if _, err := NewEd25519Signer("k", nil); err == nil {
+		t.Error("NewEd25519Signer accepted a nil key")
+	}
+}
+
+func TestSignedURLRejectsNewlineKeyIDs(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHMACSigner("k\n1", testHMACSecret); err == nil {
+		t.Error("NewHMACSigner accepted a newline in the key id")
+	}
+	if _, err := NewEd25519Signer("k\n1", priv); err == nil {
+		t.Error("NewEd25519Signer accepted a newline in the key id")
+	}
+	v, hs, _ := newTestSigners(t)
+	if err := v.AddHMACKey("k\n1", testHMACSecret); err == nil {
+		t.Error("AddHMACKey accepted a newline in the key id")
+	}
+	u := mustSign(t, hs, "/a", SignOptions{Expires: time.Now().Add(time.Minute)})
+	u = strings.Replace(u, SignKeyIDParam+"=h1", SignKeyIDParam+"=h1%0A", 1)
+	if err := v.Verify(httptest.NewRequest(http.MethodGet, u, nil), ""); err != ErrURLSignature {
+		t.Errorf("newline in the key id: %v, want %v", err, ErrURLSignature)
+	}
+}
+
+func TestSignURLRejectsNonCanonicalPath(t *testing.T) {
+	_, hs, _ := newTestSigners(t)
+	for _, p := range []string{"/a/../b", "/a//b", "a/b"} {
+		if _, err := hs.Sign(p, SignOptions{Expires: time.Now().Add(time.Minute)}); err == nil {
+			t.Errorf("signed %q", p)
+		}
+	}
+}
+
+func TestSignedURLMiddleware(t *testing.T) {
+	v, hs, _ := newTestSigners(t)
+	srv := New()
+	srv.GET("/f", func(c echo.Context) error { return c.String(http.StatusOK, "ok") }, srv.SignedURLMiddleware(v))
+	signed := mustSign(t, hs, "/f", SignOptions{Expires: time.Now().Add(time.Minute)})
+	for u, want := range map[string]int{signed: http.StatusOK, "/f": http.StatusForbidden} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", u, rec.Code, want)
+		}
+	}
+}
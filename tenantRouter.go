@@ -0,0 +1,242 @@
+package MesonTerminalEchoServer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A Tenant is how a TenantRouter serves the files of a bindname.
+type Tenant struct {
+	// Root is the directory the files of the bindname are stored in.
+	Root string
+	// Origin, if set, is where missing files are fetched from. The request
+	// path below the bindname is the origin path.
+	Origin *OriginConfig
+	// Header is added to every response, like the header argument of
+	// FileWithPause. Policy filters it and the sidecar headers.
+	Header map[string][]string
+	Policy *HeaderPolicy
+	// SidecarOptions tells how the sidecars next to the files are parsed.
+	SidecarOptions HeaderParseOptions
+	// HeaderRules, if set, replace the server's header rules.
+	HeaderRules *HeaderRuleSet
+	// ConnectionRateLimit, if not 0, replaces the server's per-connection
+	// rate limit, in bytes per second; < 0 lifts it.
+	ConnectionRateLimit int64
+	ConnectionBurst     int64
+	// Verifier, if set, requires the URLs to be signed. The signature must
+	// cover the path of the file served, so a URL ending in a slash is
+	// signed for its index file or with a path prefix.
+	Verifier *URLVerifier
+	// IndexFile is served for the bindname itself and for paths ending in
+	// a slash. Default index.html.
+	IndexFile string
+}
+
+// A TenantRouter serves the files of many bindnames from URLs like
+// /prefix/bindname/path/to/file, each with its own Tenant configuration.
+// Paths are resolved inside the tenant's Root; sidecars, temporary files
+// and other dot files are never served, nor files that symbolic links lead
+// out of the Root.
+type TenantRouter struct {
+	hs *HttpServer
+
+	mu      sync.RWMutex
+	tenants map[string]*Tenant
+}
+
+// NewTenantRouter returns a router without tenants serving through hs.
+func NewTenantRouter(hs *HttpServer) *TenantRouter {
+	return &TenantRouter{hs: hs, tenants: map[string]*Tenant{}}
+}
+
+// SetTenant serves bindName as t says, replacing its previous
+// configuration. The tenant's origin applies to its requests only; an
+// origin set on the server with SetOrigin is left alone. A nil t removes
+// the tenant.
+func (tr *TenantRouter) SetTenant(bindName string, t *Tenant) error {
+	if bindName == "" || strings.ContainsAny(bindName, "/\\") {
+		return errors.New("tenant: invalid bindname " + bindName)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if t == nil {
+		delete(tr.tenants, bindName)
+		return nil
+	}
+	if t.Root == "" {
+		return errors.New("tenant " + bindName + ": no root")
+	}
+	c := *t
+	if c.IndexFile == "" {
+		c.IndexFile = "index.html"
+	}
+	if c.Origin != nil {
+		c.Origin = c.Origin.normalized()
+	}
+	tr.tenants[bindName] = &c
+	return nil
+}
+
+// GetTenant returns the configuration of bindName, or nil.
+func (tr *TenantRouter) GetTenant(bindName string) *Tenant {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return tr.tenants[bindName]
+}
+
+// Mount routes GET and HEAD requests for prefix/:bindname and
+// prefix/:bindname/* to Handle on the server.
+func (tr *TenantRouter) Mount(prefix string, m ...echo.MiddlewareFunc) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	for _, route := range []string{prefix + "/:bindname", prefix + "/:bindname/*"} {
+		tr.hs.GET(route, tr.Handle, m...)
+		tr.hs.HEAD(route, tr.Handle, m...)
+	}
+}
+
+// Handle serves the file named by the bindname and * route parameters.
+// Paths that aren't canonical, such as ones with dot segments, get 404.
+func (tr *TenantRouter) Handle(c echo.Context) error {
+	r := c.Request()
+	bindName := c.Param("bindname")
+	name := c.Param("*")
+	if r.URL.RawPath != "" {
+		// echo routed the escaped path, so the parameters are escaped
+		var err error
+		if bindName, err = url.PathUnescape(bindName); err != nil {
+			return echo.NotFoundHandler(c)
+		}
+		if name, err = url.PathUnescape(name); err != nil {
+			return echo.NotFoundHandler(c)
+		}
+	}
+	if cleanURLPath(r.URL.Path) != r.URL.Path || hasDotSegment(name) {
+		return echo.NotFoundHandler(c)
+	}
+	// the route matched prefix/bindname/name, so the path ends with it
+	suffix := "/" + bindName
+	if name != "" || strings.HasSuffix(r.URL.Path, "/") {
+		suffix += "/" + name
+	}
+	if !strings.HasSuffix(r.URL.Path, suffix) {
+		return echo.NotFoundHandler(c)
+	}
+	prefix := strings.TrimSuffix(r.URL.Path, suffix)
+
+	t := tr.GetTenant(bindName)
+	if t == nil {
+		return echo.NotFoundHandler(c)
+	}
+	name, ok := tenantFileName(name, t.IndexFile)
+	if !ok {
+		return echo.NotFoundHandler(c)
+	}
+	if t.Verifier != nil {
+		// verify the path of the file actually served
+		servedPath := prefix + "/" + bindName + "/" + name
+		if err := t.Verifier.verify(r.URL.Query(), servedPath, tr.hs.clientIP(r)); err != nil {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+	}
+
+	filePath := filepath.Join(t.Root, filepath.FromSlash(name))
+	if !insideRoot(t.Root, filePath) {
+		return echo.NotFoundHandler(c)
+	}
+	for _, suffix := range companionSuffixes() {
+		if !insideRoot(t.Root, filePath+suffix) {
+			return echo.NotFoundHandler(c)
+		}
+	}
+	opts := []ServeOption{
+		WithBindName(bindName),
+		WithSidecar(filePath+HeaderSuffix, t.SidecarOptions),
+		WithOriginPath(name),
+	}
+	if t.Origin != nil {
+		opts = append(opts, WithOrigin(t.Origin))
+	}
+	if t.HeaderRules != nil {
+		opts = append(opts, WithHeaderRules(t.HeaderRules))
+	}
+	if t.ConnectionRateLimit != 0 {
+		opts = append(opts, WithConnectionRateLimit(t.ConnectionRateLimit, t.ConnectionBurst))
+	}
+	_, err := FileWithPause(tr.hs, c, filePath, t.Header, t.Policy, opts...)
+	return err
+}
+
+// insideRoot reports whether filePath, a path below root, stays inside root
+// once symbolic links are followed. A missing file is judged by its deepest
+// existing directory, where it would be stored when fetched.
+func insideRoot(root, filePath string) bool {
+	root = filepath.Clean(root)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		// nothing below root exists yet
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	for p := filepath.Clean(filePath); p != root; p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if os.IsNotExist(err) {
+			if filepath.Dir(p) == p {
+				return false
+			}
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		rel, err := filepath.Rel(realRoot, real)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return true
+}
+
+// hasDotSegment reports whether the slash-separated path p has a "." or
+// ".." element.
+func hasDotSegment(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "." || elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantFileName returns the slash-separated path, relative to the tenant
+// root, of the file requested as name. ok is false for names that must not
+// be served.
+func tenantFileName(name, indexFile string) (string, bool) {
+	if strings.ContainsAny(name, "\x00\\") {
+		return "", false
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += indexFile
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return "", false
+		}
+	}
+	if isSidecarPath(name) {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,182 @@
+package MesonTerminalEchoServer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTenantRouter(t *testing.T) (*HttpServer, *URLSigner, string) {
+	root := t.TempDir()
+	files := map[string]string{
+		"bind/index.html":       "bind index",
+		"bind/a b/x.txt":        "bind x",
+		"bind/a b/x.txt.header": "X-Test\n1\nyes\n",
+		"bind/other/x":          "bind other x",
+		"other/x":               "other x",
+		"signed/x":              "signed x",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := NewURLVerifier(0)
+	if err := v.AddHMACKey("k", testHMACSecret); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewHMACSigner("k", testHMACSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := New()
+	tr := NewTenantRouter(hs)
+	for _, bindName := range []string{"bind", "other"} {
+		if err := tr.SetTenant(bindName, &Tenant{Root: filepath.Join(root, bindName), Verifier: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.SetTenant("open", &Tenant{Root: filepath.Join(root, "bind")}); err != nil {
+		t.Fatal(err)
+	}
+	tr.Mount("/api/cdn")
+	return hs, signer, root
+}
+
+func tenantGet(hs *HttpServer, u string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	hs.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+	return rec
+}
+
+func TestTenantRouterServe(t *testing.T) {
+	hs, _, _ := newTestTenantRouter(t)
+	tests := []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/api/cdn/open", http.StatusOK, "bind index"},
+		{"/api/cdn/open/", http.StatusOK, "bind index"},
+		{"/api/cdn/open/a%20b/x.txt", http.StatusOK, "bind x"},
+		{"/api/cdn/open/a%20b/x.txt.header", http.StatusNotFound, ""},
+		{"/api/cdn/open/../other/x", http.StatusNotFound, ""},
+		{"/api/cdn/open/a%20b/./x.txt", http.StatusNotFound, ""},
+		{"/api/cdn/open/..%2fother/x", http.StatusNotFound, ""},
+		{"/api/cdn/open//a%20b/x.txt", http.StatusNotFound, ""},
+		{"/api/cdn/nobody/x", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := tenantGet(hs, tt.url)
+		if rec.Code != tt.code || tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.url, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+	}
+	if got := tenantGet(hs, "/api/cdn/open/a%20b/x.txt").Header().Get("X-Test"); got != "yes" {
+		t.Errorf("sidecar header X-Test %q", got)
+	}
+}
+
+func TestTenantRouterSignedURLs(t *testing.T) {
+	hs, signer, _ := newTestTenantRouter(t)
+	exp := time.Now().Add(time.Minute)
+	other := mustSign(t, signer, "/api/cdn/other/x", SignOptions{Expires: exp})
+	query := other[strings.IndexByte(other, '?'):]
+	prefixed := mustSign(t, signer, "/api/cdn/bind/a%20b/x.txt", SignOptions{Expires: exp, PathPrefix: "/api/cdn/bind/"})
+
+	tests := []struct {
+		name, url string
+		code      int
+		body      string
+	}{
+		{"signed", other, http.StatusOK, "other x"},
+		{"unsigned", "/api/cdn/other/x", http.StatusForbidden, ""},
+		// a signature for one tenant must not reach another tenant's files
+		{"dot segments into another tenant", "/api/cdn/bind/../other/x" + query, http.StatusNotFound, ""},
+		{"same path in another tenant", "/api/cdn/bind/other/x" + query, http.StatusForbidden, ""},
+		{"prefix", prefixed, http.StatusOK, "bind x"},
+		{"prefix index", "/api/cdn/bind/" + prefixed[strings.IndexByte(prefixed, '?'):], http.StatusOK, "bind index"},
+		{"prefix other tenant", "/api/cdn/other/x" + prefixed[strings.IndexByte(prefixed, '?'):], http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		rec := tenantGet(hs, tt.url)
+		if rec.Code != tt.code || tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func TestTenantRouterSymlinks(t *testing.T) {
+	hs, _, root := newTestTenantRouter(t)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(outside, "page.header"), []byte("X-Leak\n1\nyes\n"), 0644)
+	os.WriteFile(filepath.Join(root, "bind", "page"), []byte("page"), 0644)
+	links := map[string]string{
+		"bind/secret":      filepath.Join(outside, "secret"),
+		"bind/outdir":      outside,
+		"bind/page.header": filepath.Join(outside, "page.header"),
+		"bind/inside":      filepath.Join(root, "bind", "a b", "x.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Skip("no symbolic links:", err)
+		}
+	}
+	tests := []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/api/cdn/open/secret", http.StatusNotFound, ""},
+		{"/api/cdn/open/outdir/secret", http.StatusNotFound, ""},
+		{"/api/cdn/open/outdir/missing", http.StatusNotFound, ""},
+		{"/api/cdn/open/page", http.StatusNotFound, ""},
+		{"/api/cdn/open/inside", http.StatusOK, "bind x"},
+	}
+	for _, tt := range tests {
+		rec := tenantGet(hs, tt.url)
+		if rec.Code != tt.code || tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.url, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func TestTenantRouterOrigins(t *testing.T) {
+	newOrigin := func(body string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	direct, first, second := newOrigin("direct"), newOrigin("first"), newOrigin("second")
+
+	hs := New()
+	t.Cleanup(hs.CloseServer)
+	hs.SetOrigin("b", &OriginConfig{BaseURL: direct.URL})
+	for i, origin := range []*httptest.Server{first, second} {
+		tr := NewTenantRouter(hs)
+		if err := tr.SetTenant("b", &Tenant{Root: filepath.Join(t.TempDir(), "b"), Origin: &OriginConfig{BaseURL: origin.URL}}); err != nil {
+			t.Fatal(err)
+		}
+		tr.Mount("/r" + string(rune('1'+i)))
+	}
+	if cfg := hs.GetOrigin("b"); cfg == nil || cfg.BaseURL != direct.URL {
+		t.Errorf("SetTenant replaced the origin set on the server: %+v", cfg)
+	}
+	for prefix, want := range map[string]string{"/r1": "first", "/r2": "second"} {
+		if rec := tenantGet(hs, prefix+"/b/x"); rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%s: %d %q, want %q", prefix, rec.Code, rec.Body.String(), want)
+		}
+	}
+}
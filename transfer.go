@@ -0,0 +1,128 @@
+package MesonTerminalEchoServer
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A ByteRange is a part of the content sent in a 206 response.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// TransferResult describes what a FileWithPause, ServeContent or ServeFile
+// call actually sent to the client.
+type TransferResult struct {
+	// StatusCode is the status written to the client, or the status of the
+	// error returned by FileWithPause if nothing was written.
+	StatusCode int
+	// Written is the number of body bytes delivered to the client.
+	Written int64
+	// Size is the size of the full content, or -1 if unknown.
+	Size int64
+	// Ranges are the ranges served for a 206 response and nil otherwise.
+	Ranges []ByteRange
+	// Paused is the time the transfer spent waiting for a server pause.
+	Paused time.Duration
+	// Duration is the total time spent serving the request.
+	Duration time.Duration
+	// Err is the reason the body transfer stopped early, such as
+	// ErrClientGone or ErrServerClosing. It is nil for complete transfers.
+	Err error
+}
+
+// TransferInfo describes a transfer to the transfer hooks.
+type TransferInfo struct {
+	Request  *http.Request
+	ClientIP string
+	// Name is the name of the served file, as given to ServeContent.
+	Name string
+	// StatusCode is the status of the response, 200 or 206.
+	StatusCode int
+	// Size is the size of the full content, or -1 if unknown.
+	Size int64
+	// Ranges are the ranges being served for a 206 response.
+	Ranges []ByteRange
+	// SendSize is the number of body bytes the response announces, or -1
+	// if the body is compressed while it is sent.
+	SendSize int64
+}
+
+type progressHook struct {
+	every int64
+	fn    func(info *TransferInfo, written int64)
+}
+
+// transferHooks is the hook registry of an HttpServer.
+type transferHooks struct {
+	mu       sync.RWMutex
+	start    []func(info *TransferInfo)
+	progress []progressHook
+	end      []func(info *TransferInfo, result TransferResult)
+}
+
+// OnTransferStart registers fn to be called right before the body of a
+// response served by FileWithPause, ServeContent or ServeFile is sent.
+func (hs *HttpServer) OnTransferStart(fn func(info *TransferInfo)) {
+	hs.hooks.mu.Lock()
+	defer hs.hooks.mu.Unlock()
+	hs.hooks.start = append(hs.hooks.start, fn)
+}
+
+// OnProgress registers fn to be called each time another every bytes of a
+// body have been sent. written is the total sent so far.
+func (hs *HttpServer) OnProgress(every int64, fn func(info *TransferInfo, written int64)) {
+	if every <= 0 {
+		return
+	}
+	hs.hooks.mu.Lock()
+	defer hs.hooks.mu.Unlock()
+	hs.hooks.progress = append(hs.hooks.progress, progressHook{every, fn})
+}
+
+// OnTransferEnd registers fn to be called once a body transfer has ended,
+// whether it completed or was aborted.
+func (hs *HttpServer) OnTransferEnd(fn func(info *TransferInfo, result TransferResult)) {
+	hs.hooks.mu.Lock()
+	defer hs.hooks.mu.Unlock()
+	hs.hooks.end = append(hs.hooks.end, fn)
+}
+
+// transferStart runs the start hooks and returns the progress func to pass
+// to the copier (nil without progress hooks) and a func running the end hooks.
+func (h *transferHooks) transferStart(info *TransferInfo) (progress func(written int64), end func(result TransferResult)) {
+	h.mu.RLock()
+	start := h.start
+	hooks := h.progress
+	endHooks := h.end
+	h.mu.RUnlock()
+
+	for _, fn := range start {
+		fn(info)
+	}
+
+	if len(hooks) > 0 {
+		next := make([]int64, len(hooks))
+		for i, hook := range hooks {
+			next[i] = hook.every
+		}
+		progress = func(written int64) {
+			for i, hook := range hooks {
+				if written < next[i] {
+					continue
+				}
+				next[i] = written - written%hook.every + hook.every
+				hook.fn(info, written)
+			}
+		}
+	}
+
+	end = func(result TransferResult) {
+		for _, fn := range endHooks {
+			fn(info, result)
+		}
+	}
+	return progress, end
+}